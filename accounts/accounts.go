@@ -2,10 +2,13 @@ package accounts
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/distributeddesigns/currency"
 	"github.com/op/go-logging"
+
+	"github.com/distributeddesigns/milestone1/expiry"
 )
 
 var (
@@ -18,85 +21,117 @@ type Action struct {
 	Stock     string
 	Units     uint
 	UnitPrice currency.Currency
+	// Funds held for a Buy. NoReservation for Sells.
+	ReservationID ReservationID
 }
 
 // ActionQueue : Ordered queue of actions. Oldest on left, newest on right.
 type ActionQueue []Action
 
 // Portfolio : User's stock holdings, stockName -> quantity
-type Portfolio map[string]uint
+type Portfolio map[string]Shares
 
-// Account : State of a particular account
+// Account : State of a particular account. Balance is all of the user's
+// cash, including funds reserved for pending buys. See Available().
 type Account struct {
 	Balance   currency.Currency
 	BuyQueue  ActionQueue
 	SellQueue ActionQueue
 	Portfolio Portfolio
+	// What the shares in the portfolio cost, and the profit or loss on
+	// shares already sold. Both keyed by stock.
+	Lots     map[string][]Lot
+	Realized map[string]ProfitLoss
+
+	reservations      map[ReservationID]Reservation
+	lastReservationID ReservationID
+
+	// Where changes to the account are recorded
+	name   string
+	ledger *Ledger
 }
 
 // Accounts : Maps name -> Account
 type Accounts map[string]*Account
 
-// AccountStore : A collection of accouunts
+// AccountStore : A collection of accouunts. Safe for concurrent use.
+// Every change to the accounts is recorded in Ledger.
 type AccountStore struct {
-	Accounts map[string]*Account
+	Ledger *Ledger
+
+	accounts Accounts
+	mutex    sync.RWMutex
 }
 
 // NewAccountStore : A constructor that returns an initialized AccountStore
 func NewAccountStore() *AccountStore {
 	var as AccountStore
-	as.Accounts = make(Accounts)
+	as.accounts = make(Accounts)
+	as.Ledger = NewLedger()
 	return &as
 }
 
 // AddStockToPortfolio : Give a user some stock
-func (ac *Account) AddStockToPortfolio(stock string, units uint) {
-	currentUnits, ok := ac.Portfolio[stock]
-	if !ok {
-		currentUnits = 0
+func (ac *Account) AddStockToPortfolio(tx Tx, stock string, units Shares) error {
+	newUnits, err := ac.Portfolio[stock].Add(units)
+	if err != nil {
+		consoleLog.Errorf("Can't add %d %s to a holding of %d", units, stock, ac.Portfolio[stock])
+		return err
 	}
-	ac.Portfolio[stock] = currentUnits + units
+	ac.Portfolio[stock] = newUnits
+	ac.record(tx, ShareGrant, currency.Currency{}, stock, units)
+	return nil
 }
 
-// RemoveStockFromPortfolio : Remove stocks from a user
-func (ac *Account) RemoveStockFromPortfolio(stock string, units uint) bool {
-	currentUnits, ok := ac.Portfolio[stock]
-	if !ok || currentUnits-units < 0 {
+// RemoveStockFromPortfolio : Remove stocks from a user. Fails if they
+// don't have that many.
+func (ac *Account) RemoveStockFromPortfolio(tx Tx, stock string, units Shares) error {
+	newUnits, err := ac.Portfolio[stock].Sub(units)
+	if err != nil {
 		consoleLog.Notice("User does not have enough stock to sell")
-		return false
+		return err
 	}
-	ac.Portfolio[stock] = currentUnits - units
-	return true
+	ac.Portfolio[stock] = newUnits
+	ac.record(tx, ShareRemoval, currency.Currency{}, stock, units)
+	return nil
 }
 
 // GetPortfolioStockUnits : Number of units users holds of a stock
-func (ac *Account) GetPortfolioStockUnits(stock string) uint {
+func (ac *Account) GetPortfolioStockUnits(stock string) Shares {
 	return ac.Portfolio[stock]
 
 }
 
 // HasAccount : Checks if there's an existing account for the user
-func (as AccountStore) HasAccount(name string) bool {
-	_, ok := as.Accounts[name]
+func (as *AccountStore) HasAccount(name string) bool {
+	as.mutex.RLock()
+	defer as.mutex.RUnlock()
+
+	_, ok := as.accounts[name]
 	return ok
 }
 
 // GetAccount ; Grab an account if it exists for the user
-func (as AccountStore) GetAccount(name string) *Account {
-	account, ok := as.Accounts[name]
+func (as *AccountStore) GetAccount(name string) *Account {
+	as.mutex.RLock()
+	defer as.mutex.RUnlock()
+
+	account, ok := as.accounts[name]
 	if !ok {
 		return nil
 	}
 	return account
 }
 
-// AddToBuyQueue ; Add a stock S to the buy queue
-func (ac *Account) AddToBuyQueue(stock string, units uint, unitPrice currency.Currency) bool {
+// AddToBuyQueue ; Add a stock S to the buy queue. The Buy owns the
+// reservation holding its funds.
+func (ac *Account) AddToBuyQueue(stock string, units uint, unitPrice currency.Currency, reservationID ReservationID) bool {
 	currentAction := Action{
-		Time:      time.Now(),
-		Stock:     stock,
-		Units:     units,
-		UnitPrice: unitPrice,
+		Time:          time.Now(),
+		Stock:         stock,
+		Units:         units,
+		UnitPrice:     unitPrice,
+		ReservationID: reservationID,
 	}
 	ac.BuyQueue = append(ac.BuyQueue, currentAction)
 	return true
@@ -115,33 +150,42 @@ func (ac *Account) AddToSellQueue(stock string, units uint, unitPrice currency.C
 }
 
 // CreateAccount : Initialize a new account. Fail if one already exists
-func (as AccountStore) CreateAccount(name string) error {
+func (as *AccountStore) CreateAccount(name string) error {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
 	// Check for pre-existing accounts
-	if as.HasAccount(name) {
+	if _, ok := as.accounts[name]; ok {
 		return errors.New("Account already exists")
 	}
 
 	// Add account with initial values
-	as.Accounts[name] = &Account{}
+	as.accounts[name] = &Account{
+		name:   name,
+		ledger: as.Ledger,
+	}
 
 	// Initialize the account's portfolio
-	as.Accounts[name].Portfolio = make(Portfolio)
+	as.accounts[name].Portfolio = make(Portfolio)
 
 	return nil
 }
 
 // AddFunds : Increases the balance of the account
-func (ac *Account) AddFunds(amount currency.Currency) {
+func (ac *Account) AddFunds(tx Tx, amount currency.Currency) {
 	// Only allow > $0.00 to be added
 	ac.Balance.Add(amount)
+	ac.record(tx, Credit, amount, "", 0)
 }
 
-// RemoveFunds : Decrease balance of the account
-func (ac *Account) RemoveFunds(amount currency.Currency) error {
-	err := ac.Balance.Sub(amount)
-	if err != nil {
+// RemoveFunds : Decrease balance of the account. Reserved funds can't be removed.
+func (ac *Account) RemoveFunds(tx Tx, amount currency.Currency) error {
+	available := ac.Available()
+	if err := available.Sub(amount); err != nil {
 		return errors.New("Insufficient Funds")
 	}
+	ac.Balance.Sub(amount)
+	ac.record(tx, Debit, amount, "", 0)
 	return nil
 }
 
@@ -166,7 +210,11 @@ func (aq *ActionQueue) PopNewest() (Action, bool) {
 
 // IsExpired : True if the action's timestamp is older than its validity window
 func (act *Action) IsExpired() bool {
-	expiry := act.Time.Add(time.Second * 60)
-	return time.Now().After(expiry)
+	return expiry.IsExpired(act.Time)
+}
+
+// TimeLeft : How long until the action expires. Zero if it already has.
+func (act *Action) TimeLeft() time.Duration {
+	return expiry.TimeLeft(act.Time)
 }
 
@@ -0,0 +1,66 @@
+package accounts
+
+import (
+	"github.com/distributeddesigns/currency"
+)
+
+// Cost : What the action's shares are worth at its unit price. For a Buy
+// this is the amount held by its reservation.
+func (act *Action) Cost() currency.Currency {
+	var cost currency.Currency
+	cost.Add(act.UnitPrice)
+	cost.Mul(float64(act.Units))
+	return cost
+}
+
+// RemoveExpired : Takes every expired action out of the queue and returns
+// them, oldest first.
+func (aq *ActionQueue) RemoveExpired() []Action {
+	var expired []Action
+	live := (*aq)[:0]
+
+	for _, act := range *aq {
+		if act.IsExpired() {
+			expired = append(expired, act)
+		} else {
+			live = append(live, act)
+		}
+	}
+	*aq = live
+
+	return expired
+}
+
+// ExpireBuys : Removes expired Buys and gives back the funds they
+// reserved. Returns the Buys that were removed.
+func (ac *Account) ExpireBuys() []Action {
+	expired := ac.BuyQueue.RemoveExpired()
+	for _, act := range expired {
+		ac.RefundBuy(act)
+	}
+	return expired
+}
+
+// ExpireSells : Removes expired Sells and gives back the shares they
+// reserved. Returns the Sells that were removed.
+func (ac *Account) ExpireSells(tx Tx) []Action {
+	expired := ac.SellQueue.RemoveExpired()
+	for _, act := range expired {
+		ac.RefundSell(tx, act)
+	}
+	return expired
+}
+
+// RefundBuy : Releases the funds reserved by a Buy that won't be committed
+func (ac *Account) RefundBuy(act Action) {
+	if _, err := ac.ReleaseReservation(act.ReservationID); err != nil {
+		consoleLog.Errorf("Couldn't release funds for Buy of %s: %s", act.Stock, err.Error())
+	}
+}
+
+// RefundSell : Returns the shares reserved by a Sell that won't be committed
+func (ac *Account) RefundSell(tx Tx, act Action) {
+	if err := ac.AddStockToPortfolio(tx, act.Stock, Shares(act.Units)); err != nil {
+		consoleLog.Errorf("Couldn't return shares for Sell of %s: %s", act.Stock, err.Error())
+	}
+}
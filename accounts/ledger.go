@@ -0,0 +1,169 @@
+package accounts
+
+import (
+	"sync"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/commands"
+)
+
+// Tx : The transaction a change to an account is being made for
+type Tx struct {
+	ID      int
+	Command commands.CommandType
+}
+
+// EntryKind : What a ledger entry did to the account
+type EntryKind int
+
+// EntryKind enum!
+const (
+	Credit EntryKind = iota
+	Debit
+	ShareGrant
+	ShareRemoval
+)
+
+var entryKindNames = []string{
+	"credit",
+	"debit",
+	"share grant",
+	"share removal",
+}
+
+// String representation of the EntryKind enum
+func (ek EntryKind) String() string {
+	return entryKindNames[ek]
+}
+
+// MarshalText : Use the kind name when EntryKind is encoded as text or JSON
+func (ek EntryKind) MarshalText() ([]byte, error) {
+	return []byte(ek.String()), nil
+}
+
+// LedgerEntry : A single change to an account. Credits and Debits set
+// Amount; ShareGrants and ShareRemovals set Stock and Units. Balance and
+// Holding are the account's cash and units of Stock after the change.
+type LedgerEntry struct {
+	Time           time.Time
+	UserID         string
+	TransactionNum int
+	Command        commands.CommandType
+	Kind           EntryKind
+	Amount         currency.Currency
+	Stock          string
+	Units          Shares
+	Balance        currency.Currency
+	Holding        Shares
+}
+
+// LedgerQuery : Which entries to return from Ledger.Query. Empty fields
+// match everything.
+type LedgerQuery struct {
+	UserID string
+	Stock  string
+	From   time.Time
+	To     time.Time
+}
+
+func (lq LedgerQuery) matches(entry LedgerEntry) bool {
+	switch {
+	case lq.UserID != "" && lq.UserID != entry.UserID:
+		return false
+	case lq.Stock != "" && lq.Stock != entry.Stock:
+		return false
+	case !lq.From.IsZero() && entry.Time.Before(lq.From):
+		return false
+	case !lq.To.IsZero() && entry.Time.After(lq.To):
+		return false
+	}
+	return true
+}
+
+// Ledger : Append-only record of every change to every account.
+// Safe for concurrent use.
+type Ledger struct {
+	entries []LedgerEntry
+	mutex   sync.RWMutex
+}
+
+// NewLedger : A constructor that returns an empty Ledger
+func NewLedger() *Ledger {
+	return &Ledger{}
+}
+
+// Append : Adds an entry to the end of the ledger
+func (l *Ledger) Append(entry LedgerEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries = append(l.entries, entry)
+}
+
+// Rollback : Drops the entries added after the ledger had n of them.
+// Only for undoing a command that failed part way; entries are never
+// changed once their command has finished.
+func (l *Ledger) Rollback(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if n < len(l.entries) {
+		l.entries = l.entries[:n]
+	}
+}
+
+// Len : Number of entries in the ledger
+func (l *Ledger) Len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return len(l.entries)
+}
+
+// Since : Every entry after the first n, oldest first
+func (l *Ledger) Since(n int) []LedgerEntry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if n >= len(l.entries) {
+		return []LedgerEntry{}
+	}
+	return append([]LedgerEntry{}, l.entries[n:]...)
+}
+
+// Query : Entries matching the query, oldest first
+func (l *Ledger) Query(lq LedgerQuery) []LedgerEntry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	matching := []LedgerEntry{}
+	for _, entry := range l.entries {
+		if lq.matches(entry) {
+			matching = append(matching, entry)
+		}
+	}
+	return matching
+}
+
+// record : Adds a change to this account to the ledger. Accounts that
+// aren't part of a store have no ledger.
+func (ac *Account) record(tx Tx, kind EntryKind, amount currency.Currency, stock string, units Shares) {
+	if ac.ledger == nil {
+		return
+	}
+
+	ac.ledger.Append(LedgerEntry{
+		Time:           time.Now(),
+		UserID:         ac.name,
+		TransactionNum: tx.ID,
+		Command:        tx.Command,
+		Kind:           kind,
+		Amount:         amount,
+		Stock:          stock,
+		Units:          units,
+		Balance:        ac.Balance,
+		Holding:        ac.Portfolio[stock],
+	})
+}
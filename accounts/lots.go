@@ -0,0 +1,202 @@
+package accounts
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// Lot : Shares of a stock bought together at one price. Lots stay with
+// the account until the shares are sold, so shares held by a pending Sell
+// or a sell trigger still have their lots.
+type Lot struct {
+	Units     Shares
+	UnitPrice currency.Currency
+	Time      time.Time
+}
+
+// Cost : What the lot's shares cost
+func (l Lot) Cost() currency.Currency {
+	var cost currency.Currency
+	cost.Add(l.UnitPrice)
+	cost.Mul(float64(l.Units))
+	return cost
+}
+
+// LotOrder : Which lots a sale uses up first
+type LotOrder int32
+
+// LotOrder enum!
+const (
+	// FIFO : Oldest lots first
+	FIFO LotOrder = iota
+	// LIFO : Newest lots first
+	LIFO
+)
+
+// ToLotOrder : Convert string -> LotOrder enum
+func ToLotOrder(s string) (LotOrder, error) {
+	switch strings.ToLower(s) {
+	case "fifo":
+		return FIFO, nil
+	case "lifo":
+		return LIFO, nil
+	}
+	return FIFO, errors.New("Not a valid lot order")
+}
+
+// lotOrder holds a LotOrder. Read and written atomically like the expiry window.
+var lotOrder = int32(FIFO)
+
+// SetLotOrder : Changes which lots every sale from now on uses up first
+func SetLotOrder(order LotOrder) {
+	atomic.StoreInt32(&lotOrder, int32(order))
+}
+
+// ProfitLoss : A gain or a loss. Currency can't be negative so the two
+// are kept apart and netted when shown.
+type ProfitLoss struct {
+	Gain currency.Currency
+	Loss currency.Currency
+}
+
+// NewProfitLoss : The gain or loss from something that cost cost now
+// being worth value
+func NewProfitLoss(value, cost currency.Currency) ProfitLoss {
+	var pl ProfitLoss
+	pl.Gain = value
+	if err := pl.Gain.Sub(cost); err != nil {
+		pl.Gain = currency.Currency{}
+		pl.Loss = cost
+		pl.Loss.Sub(value)
+	}
+	return pl
+}
+
+// Add : Includes other in the total
+func (pl *ProfitLoss) Add(other ProfitLoss) {
+	pl.Gain.Add(other.Gain)
+	pl.Loss.Add(other.Loss)
+}
+
+// Net : Gain less loss. negative is true if it's a net loss.
+func (pl ProfitLoss) Net() (amount currency.Currency, negative bool) {
+	amount = pl.Gain
+	if err := amount.Sub(pl.Loss); err != nil {
+		amount = pl.Loss
+		amount.Sub(pl.Gain)
+		return amount, true
+	}
+	return amount, false
+}
+
+// String : The net amount with its sign, e.g. "-$1.50"
+func (pl ProfitLoss) String() string {
+	amount, negative := pl.Net()
+	if negative {
+		return fmt.Sprintf("-%s", amount)
+	}
+	return fmt.Sprintf("+%s", amount)
+}
+
+// BuyStock : Gives the user units of stock bought at unitPrice, recording
+// them as a new lot. Shares held by a pending Sell or a sell trigger still
+// count, so giving them back can't overflow the holding.
+func (ac *Account) BuyStock(tx Tx, stock string, units Shares, unitPrice currency.Currency) error {
+	owned, _, err := ac.CostBasis(stock)
+	if err != nil {
+		return err
+	}
+	if _, err := owned.Add(units); err != nil {
+		consoleLog.Errorf("Can't buy %d %s with %d already owned", units, stock, owned)
+		return err
+	}
+
+	if err := ac.AddStockToPortfolio(tx, stock, units); err != nil {
+		return err
+	}
+
+	if ac.Lots == nil {
+		ac.Lots = make(map[string][]Lot)
+	}
+	ac.Lots[stock] = append(ac.Lots[stock], Lot{units, unitPrice, time.Now()})
+
+	return nil
+}
+
+// SellLots : Uses up units of the stock's lots, in the configured order,
+// for a sale that raised proceeds. Returns the profit or loss, which is
+// added to the account's realized total. Shares without a lot, like ones
+// held before lots were kept, are treated as free.
+func (ac *Account) SellLots(stock string, units Shares, proceeds currency.Currency) ProfitLoss {
+	var cost currency.Currency
+	for _, lot := range ac.takeLots(stock, units) {
+		cost.Add(lot.Cost())
+	}
+
+	pl := NewProfitLoss(proceeds, cost)
+
+	if ac.Realized == nil {
+		ac.Realized = make(map[string]ProfitLoss)
+	}
+	realized := ac.Realized[stock]
+	realized.Add(pl)
+	ac.Realized[stock] = realized
+
+	return pl
+}
+
+// takeLots : Removes units from the stock's lots, splitting a lot if only
+// part of it is needed. Returns what was removed.
+func (ac *Account) takeLots(stock string, units Shares) []Lot {
+	lots := ac.Lots[stock]
+	var taken []Lot
+
+	for units > 0 && len(lots) > 0 {
+		// FIFO takes from the front, LIFO from the back
+		i := 0
+		if LotOrder(atomic.LoadInt32(&lotOrder)) == LIFO {
+			i = len(lots) - 1
+		}
+
+		lot := lots[i]
+		if lot.Units > units {
+			lots[i].Units -= units
+			lot.Units = units
+		} else if i == 0 {
+			lots = lots[1:]
+		} else {
+			lots = lots[:i]
+		}
+
+		taken = append(taken, lot)
+		units -= lot.Units
+	}
+
+	if len(lots) == 0 {
+		delete(ac.Lots, stock)
+	} else {
+		ac.Lots[stock] = lots
+	}
+
+	return taken
+}
+
+// CostBasis : Units of the stock with lots and what they cost. Fails if
+// the lots hold more shares than a quantity can.
+func (ac *Account) CostBasis(stock string) (Shares, currency.Currency, error) {
+	var units Shares
+	var cost currency.Currency
+	for _, lot := range ac.Lots[stock] {
+		var err error
+		if units, err = units.Add(lot.Units); err != nil {
+			return 0, currency.Currency{}, err
+		}
+		cost.Add(lot.Cost())
+	}
+	return units, cost, nil
+}
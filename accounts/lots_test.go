@@ -0,0 +1,231 @@
+package accounts_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/summary"
+)
+
+// lotsOf : An account that bought ABC in one lot per "units@price",
+// oldest first
+func lotsOf(t *testing.T, lots ...string) *accounts.Account {
+	as := accounts.NewAccountStore()
+	if err := as.CreateAccount("alice"); err != nil {
+		t.Fatal(err)
+	}
+	account := as.GetAccount("alice")
+
+	for i, lot := range lots {
+		var units accounts.Shares
+		var price string
+		if _, err := fmt.Sscanf(lot, "%d@%s", &units, &price); err != nil {
+			t.Fatalf("bad lot %q: %s", lot, err.Error())
+		}
+		tx := accounts.Tx{ID: i + 1, Command: commands.CommitBuy}
+		if err := account.BuyStock(tx, "ABC", units, testutil.Money(t, price)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return account
+}
+
+// describeLots : The stock's lots as "units@price", oldest first
+func describeLots(account *accounts.Account, stock string) []string {
+	described := []string{}
+	for _, lot := range account.Lots[stock] {
+		described = append(described, fmt.Sprintf("%d@%s", lot.Units, accounts.FormatMoney(lot.UnitPrice)))
+	}
+	return described
+}
+
+// proceeds : What units shares raise at price
+func proceeds(t *testing.T, units accounts.Shares, price string) currency.Currency {
+	total := testutil.Money(t, price)
+	total.Mul(float64(units))
+	return total
+}
+
+func TestSellLotsUsesTheLotOrder(t *testing.T) {
+	defer accounts.SetLotOrder(accounts.FIFO)
+
+	// 6 @ $2.00, then 4 @ $3.00, then 5 @ $5.00, all sold at $4.00
+	tests := []struct {
+		name     string
+		order    accounts.LotOrder
+		units    accounts.Shares
+		wantLots []string
+		wantPL   string
+	}{
+		{"fifo part of a lot", accounts.FIFO, 3, []string{"3@2.00", "4@3.00", "5@5.00"}, "+$6.00"},
+		{"fifo a whole lot", accounts.FIFO, 6, []string{"4@3.00", "5@5.00"}, "+$12.00"},
+		{"fifo across lots", accounts.FIFO, 8, []string{"2@3.00", "5@5.00"}, "+$14.00"},
+		{"fifo everything", accounts.FIFO, 15, []string{}, "+$11.00"},
+		{"lifo part of a lot", accounts.LIFO, 3, []string{"6@2.00", "4@3.00", "2@5.00"}, "-$3.00"},
+		{"lifo a whole lot", accounts.LIFO, 5, []string{"6@2.00", "4@3.00"}, "-$5.00"},
+		{"lifo across lots", accounts.LIFO, 7, []string{"6@2.00", "2@3.00"}, "-$3.00"},
+		{"lifo everything", accounts.LIFO, 15, []string{}, "+$11.00"},
+		// Shares without a lot cost nothing
+		{"more than the lots", accounts.FIFO, 17, []string{}, "+$19.00"},
+	}
+
+	for _, test := range tests {
+		accounts.SetLotOrder(test.order)
+		account := lotsOf(t, "6@2.00", "4@3.00", "5@5.00")
+
+		pl := account.SellLots("ABC", test.units, proceeds(t, test.units, "4.00"))
+
+		if got := describeLots(account, "ABC"); !reflect.DeepEqual(got, test.wantLots) {
+			t.Errorf("%s: lots left are %v, want %v", test.name, got, test.wantLots)
+		}
+		if pl.String() != test.wantPL {
+			t.Errorf("%s: sale made %s, want %s", test.name, pl, test.wantPL)
+		}
+		if realized := account.Realized["ABC"]; realized.String() != test.wantPL {
+			t.Errorf("%s: realized %s, want %s", test.name, realized, test.wantPL)
+		}
+		if _, found := account.Lots["ABC"]; found != (len(test.wantLots) > 0) {
+			t.Errorf("%s: stock still has an entry in Lots: %t", test.name, found)
+		}
+	}
+}
+
+func TestRealizedAddsUpEverySale(t *testing.T) {
+	account := lotsOf(t, "6@2.00", "4@3.00")
+
+	// $6.00 lost on the first lot, $8.00 made on the second
+	account.SellLots("ABC", 6, proceeds(t, 6, "1.00"))
+	account.SellLots("ABC", 4, proceeds(t, 4, "5.00"))
+
+	realized := account.Realized["ABC"]
+	if realized.Gain.String() != testutil.Money(t, "8.00").String() || realized.Loss.String() != testutil.Money(t, "6.00").String() {
+		t.Errorf("realized %+v, want a $8.00 gain and a $6.00 loss", realized)
+	}
+	if realized.String() != "+$2.00" {
+		t.Errorf("realized nets to %s, want +$2.00", realized)
+	}
+}
+
+func TestCostBasis(t *testing.T) {
+	tests := []struct {
+		name      string
+		lots      []string
+		wantUnits accounts.Shares
+		wantCost  string
+	}{
+		{"no lots", nil, 0, "0.00"},
+		{"one lot", []string{"6@2.00"}, 6, "12.00"},
+		{"several lots", []string{"6@2.00", "4@3.00", "5@5.00"}, 15, "49.00"},
+		{"odd cents", []string{"3@0.33", "1@10.01"}, 4, "11.00"},
+	}
+
+	for _, test := range tests {
+		account := lotsOf(t, test.lots...)
+		units, cost, err := account.CostBasis("ABC")
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if units != test.wantUnits || accounts.FormatMoney(cost) != test.wantCost {
+			t.Errorf("%s: cost basis is %d for %s, want %d for %s",
+				test.name, units, accounts.FormatMoney(cost), test.wantUnits, test.wantCost)
+		}
+	}
+
+	// Lots holding more than a quantity can, as only a bad save could
+	account := lotsOf(t)
+	account.Lots = map[string][]accounts.Lot{"ABC": {
+		{Units: maxShares, UnitPrice: testutil.Money(t, "1.00")},
+		{Units: 1, UnitPrice: testutil.Money(t, "1.00")},
+	}}
+	if _, _, err := account.CostBasis("ABC"); err == nil {
+		t.Error("cost basis of more shares than the cap didn't fail")
+	}
+}
+
+func TestNewProfitLoss(t *testing.T) {
+	tests := []struct {
+		value, cost  string
+		wantNet      string
+		wantNegative bool
+		wantString   string
+	}{
+		{"10.00", "4.00", "6.00", false, "+$6.00"},
+		{"4.00", "10.00", "6.00", true, "-$6.00"},
+		{"5.00", "5.00", "0.00", false, "+$0.00"},
+		{"0.00", "0.01", "0.01", true, "-$0.01"},
+	}
+
+	for _, test := range tests {
+		pl := accounts.NewProfitLoss(testutil.Money(t, test.value), testutil.Money(t, test.cost))
+		net, negative := pl.Net()
+		if accounts.FormatMoney(net) != test.wantNet || negative != test.wantNegative {
+			t.Errorf("worth %s after costing %s nets %s (negative %t), want %s (negative %t)",
+				test.value, test.cost, accounts.FormatMoney(net), negative, test.wantNet, test.wantNegative)
+		}
+		if pl.String() != test.wantString {
+			t.Errorf("worth %s after costing %s reads %s, want %s", test.value, test.cost, pl, test.wantString)
+		}
+	}
+}
+
+// TestRealizedAndUnrealizedStayApart : Sold shares count towards realized
+// profit and loss, the shares still held towards unrealized, and a stock
+// without a price has no unrealized profit or loss at all
+func TestRealizedAndUnrealizedStayApart(t *testing.T) {
+	account := lotsOf(t, "6@2.00", "4@3.00", "5@5.00")
+	tx := accounts.Tx{ID: 4, Command: commands.CommitBuy}
+	if err := account.BuyStock(tx, "DEF", 1, testutil.Money(t, "10.00")); err != nil {
+		t.Fatal(err)
+	}
+
+	// $32.00 for shares that cost $18.00. The 2 @ $3.00 and 5 @ $5.00
+	// left are worth $28.00.
+	account.SellLots("ABC", 8, proceeds(t, 8, "4.00"))
+	prices := map[string]currency.Currency{"ABC": testutil.Money(t, "4.00")}
+
+	s, err := summary.Build("alice", account,
+		autorequests.NewAutoRequestStore(), autorequests.NewAutoRequestStore(),
+		nil, nil, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		stock                string
+		units                accounts.Shares
+		cost                 string
+		priceKnown           bool
+		unrealized, realized string
+	}{
+		{"ABC", 7, "31.00", true, "-$3.00", "+$14.00"},
+		{"DEF", 1, "10.00", false, "+$0.00", "+$0.00"},
+	}
+
+	if len(s.Positions) != len(tests) {
+		t.Fatalf("%d positions, want %d: %+v", len(s.Positions), len(tests), s.Positions)
+	}
+	for i, test := range tests {
+		p := s.Positions[i]
+		if p.Stock != test.stock || p.Units != test.units || accounts.FormatMoney(p.CostBasis) != test.cost || p.PriceKnown != test.priceKnown {
+			t.Errorf("position %d is %d %s costing %s (price known %t), want %d %s costing %s (price known %t)",
+				i, p.Units, p.Stock, accounts.FormatMoney(p.CostBasis), p.PriceKnown,
+				test.units, test.stock, test.cost, test.priceKnown)
+		}
+		if p.Unrealized.String() != test.unrealized || p.Realized.String() != test.realized {
+			t.Errorf("%s made %s unrealized and %s realized, want %s and %s",
+				p.Stock, p.Unrealized, p.Realized, test.unrealized, test.realized)
+		}
+	}
+
+	if s.Unrealized.String() != "-$3.00" || s.Realized.String() != "+$14.00" {
+		t.Errorf("totals are %s unrealized and %s realized, want -$3.00 and +$14.00", s.Unrealized, s.Realized)
+	}
+}
@@ -0,0 +1,22 @@
+package accounts
+
+import (
+	"fmt"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// FormatMoney : c as a plain decimal, e.g. "12.50". Used wherever amounts
+// are saved or sent out so they read back exactly.
+func FormatMoney(c currency.Currency) string {
+	return fmt.Sprintf("%.2f", c.ToFloat())
+}
+
+// ParseMoney : Reads back an amount written by FormatMoney
+func ParseMoney(s string) (currency.Currency, error) {
+	c, err := currency.NewFromString(s)
+	if err != nil {
+		return currency.Currency{}, fmt.Errorf("Bad amount `%s`", s)
+	}
+	return c, nil
+}
@@ -0,0 +1,107 @@
+package accounts
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// ReservationID : Identifies a reservation within an account
+type ReservationID uint64
+
+// NoReservation : The zero ID. Used by things that don't hold funds, like Sells.
+const NoReservation ReservationID = 0
+
+// Reservation : Funds set aside for a pending Buy or automated buy. Owner
+// describes what holds the funds, e.g. "BUY ABC".
+type Reservation struct {
+	ID     ReservationID
+	Amount currency.Currency
+	Owner  string
+}
+
+var errNoReservation = errors.New("No such reservation")
+
+// Reserved : Total funds held by outstanding reservations
+func (ac *Account) Reserved() currency.Currency {
+	var reserved currency.Currency
+	for _, r := range ac.reservations {
+		reserved.Add(r.Amount)
+	}
+	return reserved
+}
+
+// Available : Funds that can be spent or reserved. Balance less Reserved.
+func (ac *Account) Available() currency.Currency {
+	available := ac.Balance
+	if err := available.Sub(ac.Reserved()); err != nil {
+		// Reservations are only made out of available funds so we
+		// should never get here.
+		consoleLog.Criticalf("Reserved funds exceed balance of %s", ac.Balance)
+		return currency.Currency{}
+	}
+	return available
+}
+
+// Reservations : Outstanding reservations, keyed by ID
+func (ac *Account) Reservations() map[ReservationID]Reservation {
+	copied := make(map[ReservationID]Reservation, len(ac.reservations))
+	for id, r := range ac.reservations {
+		copied[id] = r
+	}
+	return copied
+}
+
+// Reserve : Sets aside amount of the available funds for owner. The funds
+// stay in the Balance until the reservation is settled or released.
+func (ac *Account) Reserve(amount currency.Currency, owner string) (ReservationID, error) {
+	available := ac.Available()
+	if err := available.Sub(amount); err != nil {
+		return NoReservation, errors.New("Insufficient Funds")
+	}
+
+	if ac.reservations == nil {
+		ac.reservations = make(map[ReservationID]Reservation)
+	}
+
+	ac.lastReservationID++
+	id := ac.lastReservationID
+	ac.reservations[id] = Reservation{id, amount, owner}
+
+	return id, nil
+}
+
+// ReleaseReservation : Cancels a reservation, making its funds available
+// again. Returns the amount that was released.
+func (ac *Account) ReleaseReservation(id ReservationID) (currency.Currency, error) {
+	r, found := ac.reservations[id]
+	if !found {
+		return currency.Currency{}, errNoReservation
+	}
+
+	delete(ac.reservations, id)
+
+	return r.Amount, nil
+}
+
+// SettleReservation : Spends amount out of a reservation. The spent funds
+// leave the Balance and anything left over is released. Returns the amount
+// that was released.
+func (ac *Account) SettleReservation(tx Tx, id ReservationID, amount currency.Currency) (currency.Currency, error) {
+	r, found := ac.reservations[id]
+	if !found {
+		return currency.Currency{}, errNoReservation
+	}
+
+	leftover := r.Amount
+	if err := leftover.Sub(amount); err != nil {
+		return currency.Currency{}, fmt.Errorf("Can't spend %s out of a %s reservation", amount, r.Amount)
+	}
+
+	delete(ac.reservations, id)
+	ac.Balance.Sub(amount)
+	ac.record(tx, Debit, amount, "", 0)
+
+	return leftover, nil
+}
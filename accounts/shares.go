@@ -0,0 +1,32 @@
+package accounts
+
+import (
+	"errors"
+	"math"
+)
+
+// Shares : A number of units of a stock. Use Add and Sub rather than + and -
+// so a bad quantity is an error instead of wrapping around.
+type Shares uint
+
+var (
+	errNotEnoughShares = errors.New("Not enough shares")
+	errTooManyShares   = errors.New("Too many shares")
+)
+
+// Add : s plus n. Fails rather than overflowing. Quantities are capped at
+// math.MaxUint32 so the limit is the same on every platform.
+func (s Shares) Add(n Shares) (Shares, error) {
+	if n > math.MaxUint32 || s > math.MaxUint32-n {
+		return s, errTooManyShares
+	}
+	return s + n, nil
+}
+
+// Sub : s less n. Fails if n is more than s.
+func (s Shares) Sub(n Shares) (Shares, error) {
+	if n > s {
+		return s, errNotEnoughShares
+	}
+	return s - n, nil
+}
@@ -0,0 +1,180 @@
+package accounts_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+)
+
+const maxShares = math.MaxUint32
+
+func TestSharesAdd(t *testing.T) {
+	add := func(a, b uint32) bool {
+		sum, err := accounts.Shares(a).Add(accounts.Shares(b))
+		if uint64(a)+uint64(b) > maxShares {
+			return err != nil && sum == accounts.Shares(a)
+		}
+		return err == nil && uint64(sum) == uint64(a)+uint64(b)
+	}
+	if err := quick.Check(add, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Quantities past the cap are never valid, even when adding nothing
+	if _, err := accounts.Shares(maxShares).Add(1); err == nil {
+		t.Error("added past the cap")
+	}
+	if _, err := accounts.Shares(0).Add(accounts.Shares(maxShares)); err != nil {
+		t.Errorf("can't add up to the cap: %s", err.Error())
+	}
+}
+
+func TestSharesSub(t *testing.T) {
+	sub := func(a, b uint32) bool {
+		diff, err := accounts.Shares(a).Sub(accounts.Shares(b))
+		if b > a {
+			return err != nil && diff == accounts.Shares(a)
+		}
+		return err == nil && uint32(diff) == a-b
+	}
+	if err := quick.Check(sub, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// randomUnits : Mostly small quantities, with enough near the cap to
+// overflow a holding now and then
+func randomUnits(r *rand.Rand) uint64 {
+	switch r.Intn(4) {
+	case 0:
+		return maxShares - uint64(r.Intn(20))
+	case 1:
+		return uint64(r.Uint32())
+	default:
+		return uint64(r.Intn(20))
+	}
+}
+
+// holding : What the account should have of a stock. Quantities are
+// uint64 so the model can't wrap around itself.
+type holding struct {
+	portfolio uint64
+	pending   []uint64 // Sells, oldest first
+	owned     uint64   // Portfolio plus pending, all with lots
+}
+
+func (h holding) check(t *testing.T, seed int64, step int, op string, account *accounts.Account) {
+	fail := func(format string, args ...interface{}) {
+		t.Fatalf("seed %d, step %d (%s): "+format, append([]interface{}{seed, step, op}, args...)...)
+	}
+
+	if got := uint64(account.GetPortfolioStockUnits("ABC")); got != h.portfolio {
+		fail("portfolio holds %d, want %d", got, h.portfolio)
+	}
+
+	if len(account.SellQueue) != len(h.pending) {
+		fail("%d pending sells, want %d", len(account.SellQueue), len(h.pending))
+	}
+	for i, units := range h.pending {
+		if uint64(account.SellQueue[i].Units) != units {
+			fail("sell %d holds %d, want %d", i, account.SellQueue[i].Units, units)
+		}
+	}
+
+	units, _, err := account.CostBasis("ABC")
+	if err != nil {
+		fail("cost basis: %s", err.Error())
+	}
+	if uint64(units) != h.owned {
+		fail("lots hold %d, want %d", units, h.owned)
+	}
+	if h.owned > maxShares {
+		fail("owns %d shares, more than the cap", h.owned)
+	}
+}
+
+// TestRandomTradesKeepEveryShare : Random sequences of buys, sells,
+// commits and cancels. Shares are never created, lost or wrapped around:
+// a step that would take a holding below zero or past the cap fails and
+// changes nothing.
+func TestRandomTradesKeepEveryShare(t *testing.T) {
+	price := testutil.Money(t, "1.00")
+
+	for seed := int64(1); seed <= 200; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		as := accounts.NewAccountStore()
+		if err := as.CreateAccount("alice"); err != nil {
+			t.Fatal(err)
+		}
+		account := as.GetAccount("alice")
+		var h holding
+
+		for step := 0; step < 200; step++ {
+			tx := accounts.Tx{ID: step + 1}
+			var op string
+
+			switch r.Intn(4) {
+			case 0:
+				units := randomUnits(r)
+				op = "buy"
+				tx.Command = commands.CommitBuy
+				err := account.BuyStock(tx, "ABC", accounts.Shares(units), price)
+				if fits := h.owned+units <= maxShares; fits != (err == nil) {
+					t.Fatalf("seed %d, step %d: buying %d with %d owned returned %v", seed, step, units, h.owned, err)
+				}
+				if err == nil {
+					h.portfolio += units
+					h.owned += units
+				}
+
+			case 1:
+				units := randomUnits(r)
+				op = "sell"
+				tx.Command = commands.Sell
+				err := account.RemoveStockFromPortfolio(tx, "ABC", accounts.Shares(units))
+				if enough := units <= h.portfolio; enough != (err == nil) {
+					t.Fatalf("seed %d, step %d: selling %d of %d returned %v", seed, step, units, h.portfolio, err)
+				}
+				if err == nil {
+					account.AddToSellQueue("ABC", uint(units), price)
+					h.portfolio -= units
+					h.pending = append(h.pending, units)
+				}
+
+			case 2:
+				op = "commit"
+				sell, found := account.SellQueue.PopNewest()
+				if found != (len(h.pending) > 0) {
+					t.Fatalf("seed %d, step %d: found a sell to commit: %t", seed, step, found)
+				}
+				if found {
+					proceeds := price
+					proceeds.Mul(float64(sell.Units))
+					account.SellLots("ABC", accounts.Shares(sell.Units), proceeds)
+					h.owned -= h.pending[len(h.pending)-1]
+					h.pending = h.pending[:len(h.pending)-1]
+				}
+
+			case 3:
+				op = "cancel"
+				tx.Command = commands.CancelSell
+				sell, found := account.SellQueue.PopNewest()
+				if found != (len(h.pending) > 0) {
+					t.Fatalf("seed %d, step %d: found a sell to cancel: %t", seed, step, found)
+				}
+				if found {
+					account.RefundSell(tx, sell)
+					h.portfolio += h.pending[len(h.pending)-1]
+					h.pending = h.pending[:len(h.pending)-1]
+				}
+			}
+
+			h.check(t, seed, step, op, account)
+		}
+	}
+}
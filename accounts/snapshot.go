@@ -0,0 +1,134 @@
+package accounts
+
+import (
+	"sort"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// Snapshot : A copy of everything in an account. Used to save accounts
+// to disk and rebuild them on startup.
+type Snapshot struct {
+	Balance           currency.Currency
+	BuyQueue          ActionQueue
+	SellQueue         ActionQueue
+	Portfolio         Portfolio
+	Lots              map[string][]Lot
+	Realized          map[string]ProfitLoss
+	Reservations      []Reservation
+	LastReservationID ReservationID
+}
+
+// Snapshot : Copies the account's state
+func (ac *Account) Snapshot() Snapshot {
+	s := Snapshot{
+		Balance:           ac.Balance,
+		BuyQueue:          append(ActionQueue{}, ac.BuyQueue...),
+		SellQueue:         append(ActionQueue{}, ac.SellQueue...),
+		Portfolio:         make(Portfolio, len(ac.Portfolio)),
+		Lots:              copyLots(ac.Lots),
+		Realized:          copyRealized(ac.Realized),
+		Reservations:      []Reservation{},
+		LastReservationID: ac.lastReservationID,
+	}
+
+	for stock, units := range ac.Portfolio {
+		s.Portfolio[stock] = units
+	}
+
+	for _, r := range ac.reservations {
+		s.Reservations = append(s.Reservations, r)
+	}
+	sort.Sort(byReservationID(s.Reservations))
+
+	return s
+}
+
+// Copy : A deep copy of the snapshot. Snapshots share their queues and
+// maps when assigned.
+func (s Snapshot) Copy() Snapshot {
+	copied := s
+	copied.BuyQueue = append(ActionQueue{}, s.BuyQueue...)
+	copied.SellQueue = append(ActionQueue{}, s.SellQueue...)
+	copied.Reservations = append([]Reservation{}, s.Reservations...)
+	copied.Lots = copyLots(s.Lots)
+	copied.Realized = copyRealized(s.Realized)
+	copied.Portfolio = make(Portfolio, len(s.Portfolio))
+	for stock, units := range s.Portfolio {
+		copied.Portfolio[stock] = units
+	}
+	return copied
+}
+
+func copyLots(lots map[string][]Lot) map[string][]Lot {
+	copied := make(map[string][]Lot, len(lots))
+	for stock, stockLots := range lots {
+		copied[stock] = append([]Lot{}, stockLots...)
+	}
+	return copied
+}
+
+func copyRealized(realized map[string]ProfitLoss) map[string]ProfitLoss {
+	copied := make(map[string]ProfitLoss, len(realized))
+	for stock, pl := range realized {
+		copied[stock] = pl
+	}
+	return copied
+}
+
+type byReservationID []Reservation
+
+func (r byReservationID) Len() int           { return len(r) }
+func (r byReservationID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byReservationID) Less(i, j int) bool { return r[i].ID < r[j].ID }
+
+// RestoreAccount : Replaces name's account with one built from a snapshot,
+// creating the account if needed
+func (as *AccountStore) RestoreAccount(name string, s Snapshot) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	account := &Account{
+		Balance:           s.Balance,
+		BuyQueue:          append(ActionQueue{}, s.BuyQueue...),
+		SellQueue:         append(ActionQueue{}, s.SellQueue...),
+		Portfolio:         make(Portfolio, len(s.Portfolio)),
+		Lots:              copyLots(s.Lots),
+		Realized:          copyRealized(s.Realized),
+		reservations:      make(map[ReservationID]Reservation, len(s.Reservations)),
+		lastReservationID: s.LastReservationID,
+		name:              name,
+		ledger:            as.Ledger,
+	}
+
+	for stock, units := range s.Portfolio {
+		account.Portfolio[stock] = units
+	}
+
+	for _, r := range s.Reservations {
+		account.reservations[r.ID] = r
+	}
+
+	as.accounts[name] = account
+}
+
+// RemoveAccount : Deletes name's account, if there is one
+func (as *AccountStore) RemoveAccount(name string) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	delete(as.accounts, name)
+}
+
+// Names : Every user with an account, sorted
+func (as *AccountStore) Names() []string {
+	as.mutex.RLock()
+	defer as.mutex.RUnlock()
+
+	names := make([]string, 0, len(as.accounts))
+	for name := range as.accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
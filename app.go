@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/distributeddesigns/currency"
 	"github.com/op/go-logging"
@@ -15,26 +20,184 @@ import (
 	"github.com/distributeddesigns/milestone1/auditlogger"
 	"github.com/distributeddesigns/milestone1/autorequests"
 	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/expiry"
+	"github.com/distributeddesigns/milestone1/invariants"
+	"github.com/distributeddesigns/milestone1/persist"
 	"github.com/distributeddesigns/milestone1/quotecache"
+	"github.com/distributeddesigns/milestone1/repository"
+	"github.com/distributeddesigns/milestone1/summary"
+	"github.com/distributeddesigns/milestone1/unitofwork"
 )
 
+// The database -store=sqlite keeps in -datadir
+const sqliteFilename = "accounts.db"
+
+// The audit log kept in -datadir so it carries on across runs
+const auditFilename = "audit.xml"
+
 // Globals
 var (
 	consoleLog = logging.MustGetLogger("console")
 
-	logLevel = flag.String("loglevel", "WARNING", "CRITICAL, ERROR, WARNING,  NOTICE, INFO, DEBUG")
+	logLevel      = flag.String("loglevel", "WARNING", "CRITICAL, ERROR, WARNING,  NOTICE, INFO, DEBUG")
+	quoteSource   = flag.String("quotesource", "tcp", "tcp: use the quoteserver, fake: make up quotes in-process")
+	quoteServers  = flag.String("quoteservers", "", "Comma separated NAME=host:port quoteservers. Defaults based on ENV")
+	quotePick     = flag.String("quotepick", "roundrobin", "How to pick a quoteserver: roundrobin, latency")
+	perUserQuotes = flag.Bool("peruserquotes", false, "Only serve cached quotes to the user they were fetched for")
+	quoteTimeout  = flag.Duration("quotetimeout", time.Second*10, "How long to wait for a quoteserver to answer before trying again")
+	quoteAttempts = flag.Int("quoteattempts", 3, "Times to try the quoteserver before failing a command")
+	breakerLimit  = flag.Int("breakerlimit", 5, "Consecutive quoteserver failures before failing fast. 0 disables")
+	breakerWait   = flag.Duration("breakerwait", time.Second*30, "How long to fail fast before probing the quoteserver again")
+	staleQuotes   = flag.Duration("stalequotes", 0, "How long past expiry a quote can be served while failing fast")
+	expiryWindow  = flag.Duration("expiry", expiry.DefaultWindow, "How long quotes, buys and sells stay valid")
+	dataDir       = flag.String("datadir", "", "Directory to keep accounts in across runs. Accounts are only kept in memory if empty")
+	fsyncPolicy   = flag.String("fsync", "interval", "When to flush account changes to disk: always, interval, never")
+	fsyncInterval = flag.Duration("fsyncinterval", time.Second, "How often to flush account changes to disk with -fsync=interval")
+	lotOrder      = flag.String("lotorder", "fifo", "Which shares a sale uses up first for profit and loss: fifo, lifo")
+	snapshotEvery = flag.Int("snapshotevery", 10000, "Commands between account snapshots. 0 only snapshots on exit")
+	storeKind     = flag.String("store", "journal", "How accounts are kept in -datadir: journal, sqlite")
+	reconcile     = flag.Bool("reconcile", false, "Check the saved accounts for problems and exit without running a workload")
+	checkEach     = flag.Bool("checkinvariants", false, "Check the accounts a command touched, and the total cash, for problems after every command")
+	pollInterval  = flag.Duration("pollinterval", 0, "How often to refresh quotes for stocks with armed triggers. 0 disables")
+	pollFast      = flag.Duration("pollfast", time.Second*5, "How often to refresh a quote that's near a trigger price")
+	pollNear      = flag.Float64("pollnear", 0.02, "How close to a trigger, as a fraction of the price, polls at -pollfast")
+	pollRate      = flag.Float64("pollrate", 10, "Most quoteserver requests per second made by polling. 0 is no limit")
+	firstFill     = flag.Int("firstfill", 1000000000, "Transaction number of the first trigger fill. Keep it above the workload's")
+	summaryFormat = flag.String("summaryformat", "text", "How DISPLAY_SUMMARY is printed to stdout: text, json")
 
 	accountStore         = accounts.NewAccountStore()
 	autoBuyRequestStore  = autorequests.NewAutoRequestStore()
 	autoSellRequestStore = autorequests.NewAutoRequestStore()
+
+	// Set up in main() once we know which quote source to use
+	quoteCache *quotecache.Cache
+
+	// Set up in main(). Fills triggers as quotes come in.
+	triggerEngine *autorequests.Engine
+
+	// Set up in main() with -datadir. Every command's changes are saved to it.
+	repo repository.AccountRepository
+
+	// Set up in main() with -checkinvariants
+	checker *invariants.Checker
+
+	// Held while a workload command or the fills a poll set off run, so
+	// they never change accounts at the same time
+	workMutex sync.Mutex
+	// The newest workload command run or saved. Polled fills are saved
+	// as part of it, so a resumed run carries on after it. Guarded by
+	// workMutex.
+	lastCommand int
+)
+
+// Reasons a command can fail. These end up in the <errorMessage> of
+// an errorEvent so keep them short.
+var (
+	errNotImplemented    = errors.New("command not implemented")
+	errWrongArgCount     = errors.New("wrong number of arguments")
+	errMissingAmount     = errors.New("no amount given")
+	errMissingStock      = errors.New("no stock given")
+	errMissingFilename   = errors.New("no filename given")
+	errBadAmount         = errors.New("invalid dollar amount")
+	errNoAccount         = errors.New("user does not have an account")
+	errInsufficientFunds = errors.New("insufficient funds")
+	errInsufficientStock = errors.New("insufficient stock")
+	errLessThanOneShare  = errors.New("amount is less than one share")
+	errNoActiveBuy       = errors.New("no active buy")
+	errNoActiveSell      = errors.New("no active sell")
+	errBuyExpired        = errors.New("buy has expired")
+	errSellExpired       = errors.New("sell has expired")
+	errNoAutoBuy         = errors.New("no automated buy for stock")
+	errNoAutoSell        = errors.New("no automated sell for stock")
+	errBadTriggerID      = errors.New("invalid trigger id")
 )
 
 func main() {
 	flag.Parse()
 	consoleLoggingInit()
-	closeAuditLogger := auditlogger.Init()
+	closeAuditLogger := openAuditLog()
 	defer closeAuditLogger()
 
+	expiry.SetWindow(*expiryWindow)
+
+	order, err := accounts.ToLotOrder(*lotOrder)
+	if err != nil {
+		consoleLog.Criticalf("Unknown lot order: %s", *lotOrder)
+		os.Exit(1)
+	}
+	accounts.SetLotOrder(order)
+
+	if *summaryFormat != "text" && *summaryFormat != "json" {
+		consoleLog.Criticalf("Unknown summary format: %s", *summaryFormat)
+		os.Exit(1)
+	}
+
+	switch *quoteSource {
+	case "tcp":
+		quoteCache = quotecache.NewCache(newQuoteServerPool())
+	case "fake":
+		consoleLog.Notice("Using fake quotes")
+		quoteCache = quotecache.NewCache(quotecache.NewFakeQuoteSource(nil, 1))
+	default:
+		consoleLog.Criticalf("Unknown quote source: %s", *quoteSource)
+		os.Exit(1)
+	}
+	quoteCache.SetPerUserCaching(*perUserQuotes)
+	quoteCache.SetRetryPolicy(quotecache.RetryPolicy{
+		MaxAttempts: *quoteAttempts,
+		BaseDelay:   time.Millisecond * 100,
+		MaxDelay:    time.Second * 2,
+	})
+	if *breakerLimit > 0 {
+		quoteCache.SetCircuitBreaker(quotecache.NewCircuitBreaker(*breakerLimit, *breakerWait))
+		quoteCache.SetStaleWindow(*staleQuotes)
+	}
+
+	triggerEngine = autorequests.NewEngine(
+		autoBuyRequestStore, autoSellRequestStore,
+		fillBuyTrigger, fillSellTrigger,
+		*firstFill,
+	)
+	triggerEngine.Subscribe(quoteCache)
+
+	resumeAfter := 0
+	if *dataDir != "" {
+		resumeAfter = openRepository()
+		defer func() {
+			if err := repo.Close(); err != nil {
+				consoleLog.Critical(err.Error())
+			}
+		}()
+	}
+
+	if *reconcile {
+		runReconcile()
+		return
+	}
+
+	if resumeAfter > 0 {
+		consoleLog.Noticef("Resuming after transaction %d", resumeAfter)
+	}
+	lastCommand = resumeAfter
+
+	if *checkEach {
+		checker = invariants.NewChecker(accountStore, autoBuyRequestStore, autoSellRequestStore)
+		// Catch up on anything restored so only new problems are blamed on commands
+		reportViolations(checker.CheckAll())
+	}
+
+	if *pollInterval > 0 {
+		poller := autorequests.NewPoller(quoteCache, triggerEngine, autorequests.PollerOptions{
+			Interval:     *pollInterval,
+			FastInterval: *pollFast,
+			Near:         *pollNear,
+			RateLimit:    *pollRate,
+			RunFills:     runPolledFills,
+		})
+		poller.Start()
+		defer poller.Stop()
+	}
+
 	// Find the workload file and open it
 	// -  Read each line and:
 	// -    parse the command
@@ -65,13 +228,13 @@ func main() {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		cmd := parseCommand(scanner.Text())
-		if err := executeCommand(cmd); err != nil {
-			// if it fails, log and continue on
-			consoleLog.Errorf("Command execution error! cmd # %3d message: %s", cmd.ID, err.Error())
+
+		// Resuming after a crash. This command has already been saved.
+		if cmd.ID <= resumeAfter {
+			continue
 		}
 
-		// Record command in the audit log
-		auditlogger.LogCommand(cmd)
+		runWorkloadCommand(cmd)
 	}
 
 	// catch read errors
@@ -83,6 +246,197 @@ func main() {
 	consoleLog.Debugf("Done!")
 }
 
+// Runs a command from the workload, then checks and saves what it changed
+func runWorkloadCommand(cmd commands.Command) {
+	workMutex.Lock()
+	defer workMutex.Unlock()
+	lastCommand = cmd.ID
+
+	// Record command in the audit log before any of the events it causes
+	auditlogger.LogCommand(cmd)
+
+	ledgerBefore := accountStore.Ledger.Len()
+
+	if err := executeCommand(cmd); err != nil {
+		// if it fails, log and continue on
+		consoleLog.Errorf("Command execution error! cmd # %3d message: %s", cmd.ID, err.Error())
+	}
+
+	// Fill any triggers set off by quotes fetched since the last
+	// command. They're saved along with it.
+	filled := triggerEngine.RunPending()
+
+	userIDs, newEntries := touchedUsers(cmd, filled, ledgerBefore)
+	if checker != nil {
+		reportViolations(checker.CheckUsers(cmd, userIDs))
+	}
+	saveChanges(cmd.ID, userIDs, newEntries)
+}
+
+// Fills the triggers a poll set off between commands, then checks and
+// saves what they changed like a command would
+func runPolledFills() {
+	workMutex.Lock()
+	defer workMutex.Unlock()
+
+	ledgerBefore := accountStore.Ledger.Len()
+	filled := triggerEngine.RunPending()
+	if len(filled) == 0 {
+		return
+	}
+
+	// Problems are blamed on the last fill
+	last := filled[len(filled)-1]
+	cmd := commands.Command{ID: last.TransactionNum, Name: last.Command, UserID: last.UserID}
+
+	userIDs, newEntries := touchedUsers(cmd, filled, ledgerBefore)
+	if checker != nil {
+		reportViolations(checker.CheckUsers(cmd, userIDs))
+	}
+	saveChanges(lastCommand, userIDs, newEntries)
+}
+
+// Builds the quoteserver pool from the runtime flags
+func newQuoteServerPool() *quotecache.PoolQuoteSource {
+	endpoints := quotecache.DefaultEndpoints()
+	if *quoteServers != "" {
+		var err error
+		endpoints, err = quotecache.ParseEndpoints(*quoteServers)
+		if err != nil {
+			consoleLog.Critical(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	strategy, err := quotecache.ToSelectionStrategy(*quotePick)
+	if err != nil {
+		consoleLog.Criticalf("Unknown quoteserver selection: %s", *quotePick)
+		os.Exit(1)
+	}
+
+	return quotecache.NewPoolQuoteSource(endpoints, strategy, *quoteTimeout)
+}
+
+// Opens the journal in -datadir
+func openJournal() *persist.Journal {
+	policy, err := persist.ToSyncPolicy(*fsyncPolicy)
+	if err != nil {
+		consoleLog.Criticalf("Unknown fsync policy: %s", *fsyncPolicy)
+		os.Exit(1)
+	}
+
+	j, err := persist.Open(*dataDir, persist.Options{
+		Sync:          policy,
+		SyncInterval:  *fsyncInterval,
+		SnapshotEvery: *snapshotEvery,
+	})
+	if err != nil {
+		consoleLog.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	return j
+}
+
+// Opens the -store repository in -datadir and fills the stores from it.
+// Returns the newest transaction it has saved.
+// openAuditLog : A new audit log in ./logs, or with -datadir, the one
+// kept there. Returns the function that closes it.
+func openAuditLog() func() {
+	if *dataDir == "" {
+		return auditlogger.Init()
+	}
+
+	closeAuditLogger, err := auditlogger.Resume(filepath.Join(*dataDir, auditFilename))
+	if err != nil {
+		consoleLog.Critical(err.Error())
+		os.Exit(1)
+	}
+	return closeAuditLogger
+}
+
+func openRepository() int {
+	switch *storeKind {
+	case "journal":
+		repo = openJournal()
+	case "sqlite":
+		if err := os.MkdirAll(*dataDir, 0755); err != nil {
+			consoleLog.Critical(err.Error())
+			os.Exit(1)
+		}
+		sqlRepo, err := repository.OpenSQLite(filepath.Join(*dataDir, sqliteFilename))
+		if err != nil {
+			consoleLog.Critical(err.Error())
+			os.Exit(1)
+		}
+		repo = sqlRepo
+	default:
+		consoleLog.Criticalf("Unknown store: %s", *storeKind)
+		os.Exit(1)
+	}
+
+	lastTransaction, nextFill, err := repository.Load(repo, accountStore, autoBuyRequestStore, autoSellRequestStore)
+	if err != nil {
+		consoleLog.Critical(err.Error())
+		os.Exit(1)
+	}
+	consoleLog.Noticef("Restored %d accounts from %s up to transaction %d",
+		len(accountStore.Names()), *dataDir, lastTransaction)
+
+	// Fills already made keep their numbers
+	if nextFill > triggerEngine.NextTransaction() {
+		triggerEngine.SetNextTransaction(nextFill)
+	}
+
+	return lastTransaction
+}
+
+// The users cmd may have changed and the ledger entries it made. Trigger
+// fills change their owners' accounts and triggers too, even when they
+// expire a trigger without making a ledger entry, so the owners of the
+// fills and anyone with new ledger entries are included along with the user.
+func touchedUsers(cmd commands.Command, filled []autorequests.Fill, ledgerBefore int) ([]string, []accounts.LedgerEntry) {
+	newEntries := accountStore.Ledger.Since(ledgerBefore)
+
+	touched := make(map[string]bool)
+	var userIDs []string
+	touch := func(userID string) {
+		if userID != "" && !touched[userID] {
+			touched[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	touch(cmd.UserID)
+	for _, fill := range filled {
+		touch(fill.UserID)
+	}
+	for _, entry := range newEntries {
+		touch(entry.UserID)
+	}
+
+	return userIDs, newEntries
+}
+
+// Saves the changes to the users' accounts, as of the workload's
+// lastTransaction. Without -datadir there's nowhere to save them.
+func saveChanges(lastTransaction int, userIDs []string, newEntries []accounts.LedgerEntry) {
+	if repo == nil {
+		return
+	}
+
+	err := repository.Save(
+		repo, lastTransaction, triggerEngine.NextTransaction(), accountStore,
+		autoBuyRequestStore, autoSellRequestStore,
+		userIDs, newEntries,
+	)
+	if err != nil {
+		// Carrying on would lose track of what's been saved
+		consoleLog.Critical(err.Error())
+		os.Exit(1)
+	}
+}
+
 func consoleLoggingInit() {
 	// TODO: DONE 1. Make a logger that outputs to console
 	// TODO: DONE 2. Set variable output levels based on runtime flag
@@ -124,7 +478,6 @@ func parseCommand(s string) commands.Command {
 	parts := strings.Split(csv, ",")
 
 	// Almost all commands will follow this format
-	// TODO: Deal with the final "DUMPLOG,./testLOG"
 	ID, _ := strconv.Atoi(parts[0])
 	name, _ := commands.ToCommandType(parts[1])
 	parsed := commands.Command{
@@ -134,63 +487,86 @@ func parseCommand(s string) commands.Command {
 		Args:   parts[3:],
 	}
 
+	// The admin "DUMPLOG,./testLOG" has no user, only a filename
+	if name == commands.DumpLog && len(parts) == 3 {
+		parsed.UserID = ""
+		parsed.Args = parts[2:]
+	}
+
 	consoleLog.Debugf("Parsed as: %+v", parsed)
 
 	return parsed
 }
 
 func executeCommand(cmd commands.Command) error {
-	// Each command will return true if everything is okay, false if error
-	var status bool
+	// Each command will return nil if everything is okay, or an error
+	// describing why the command could not be completed.
+	var err error
+
+	// Give back anything held by the user's expired Buys and Sells
+	// before the command gets a look at the account.
+	sweepExpired(cmd)
+
+	// The command's changes are all kept, or if it fails, all undone
+	work := unitofwork.Begin(accountStore, autoBuyRequestStore, autoSellRequestStore)
 
 	// Filter based on the "enum" of command names
 	switch cmd.Name {
 	case commands.Add:
-		status = executeAdd(cmd)
+		err = executeAdd(cmd, work)
 	case commands.Quote:
-		status = executeQuote(cmd)
+		err = executeQuote(cmd, work)
 	case commands.Buy:
-		status = executeBuy(cmd)
+		err = executeBuy(cmd, work)
 	case commands.CommitBuy:
-		status = executeCommitBuy(cmd)
+		err = executeCommitBuy(cmd, work)
 	case commands.CancelBuy:
-		status = executeCancelBuy(cmd)
+		err = executeCancelBuy(cmd, work)
 	case commands.Sell:
-		status = executeSell(cmd)
+		err = executeSell(cmd, work)
 	case commands.CommitSell:
-		status = executeCommitSell(cmd)
+		err = executeCommitSell(cmd, work)
 	case commands.CancelSell:
-		status = executeCancelSell(cmd)
+		err = executeCancelSell(cmd, work)
 	case commands.SetBuyAmount:
-		status = executeSetBuyAmount(cmd)
+		err = executeSetBuyAmount(cmd, work)
 	case commands.SetSellAmount:
-		status = executeSetSellAmount(cmd)
+		err = executeSetSellAmount(cmd, work)
 	case commands.CancelSetBuy:
-		status = executeCancelSetBuy(cmd)
+		err = executeCancelSetBuy(cmd, work)
 	case commands.CancelSetSell:
-		status = executeCancelSetSell(cmd)
+		err = executeCancelSetSell(cmd, work)
 	case commands.SetBuyTrigger:
-		status = executeSetBuyTrigger(cmd)
+		err = executeSetBuyTrigger(cmd, work)
 	case commands.SetSellTrigger:
-		status = executeSetSellTrigger(cmd)
+		err = executeSetSellTrigger(cmd, work)
+	case commands.DisplaySummary:
+		err = executeDisplaySummary(cmd)
+	case commands.DumpLog:
+		err = executeDumpLog(cmd)
 
 	default:
 		consoleLog.Warningf("Not implemented: %s", cmd.Name)
-		return nil
+		err = errNotImplemented
 	}
 
 	// report our status
-	if status {
+	if err == nil {
+		work.Commit()
 		consoleLog.Debugf("Finished command %d", cmd.ID)
 	} else {
+		work.Rollback()
+		// A failed COMMIT can put an expired Buy or Sell back in its queue
+		sweepExpired(cmd)
 		consoleLog.Debugf("Finished command %d with errors", cmd.ID)
+		auditlogger.LogError(cmd, err.Error())
 	}
 
-	return nil
+	return err
 }
 
 // Add funds to the user's account
-func executeAdd(cmd commands.Command) bool {
+func executeAdd(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	// Finish parsing the rest of the command.
 	// ADD should have an amount passed
 
@@ -198,11 +574,11 @@ func executeAdd(cmd commands.Command) bool {
 	if len(cmd.Args) != 1 {
 		// too many
 		consoleLog.Errorf("Wrong number of commands: `%s`", cmd.Args)
-		return false
+		return errWrongArgCount
 	} else if cmd.Args[0] == "" {
 		// missing
 		consoleLog.Error("No amount passed to ADD")
-		return false
+		return errMissingAmount
 	}
 
 	// Convert to a centInt
@@ -210,92 +586,66 @@ func executeAdd(cmd commands.Command) bool {
 	if err != nil {
 		// Bail on parse failure
 		consoleLog.Error("Failed to parse currency")
-		return false
+		return errBadAmount
 	}
 
 	// Create an account if the user needs one
-	if !accountStore.HasAccount(cmd.UserID) {
+	account := work.Account(cmd.UserID)
+	if account == nil {
 		consoleLog.Noticef("Creating account for %s", cmd.UserID)
 		if err := accountStore.CreateAccount(cmd.UserID); err != nil {
 			consoleLog.Error(err.Error())
-			return false
+			return err
 		}
+		account = work.Account(cmd.UserID)
 	}
 
 	// Add the amount
 	consoleLog.Infof("Adding %s to %s", amount, cmd.UserID)
-	accountStore.Accounts[cmd.UserID].AddFunds(amount)
+	account.AddFunds(txFor(cmd), amount)
+	logAccountTransaction(work, auditlogger.AddAction, cmd.UserID, amount, cmd.ID)
 
-	balance := accountStore.Accounts[cmd.UserID].Balance
-	consoleLog.Infof("New balance for %s is %s", cmd.UserID, balance)
+	consoleLog.Infof("New balance for %s is %s", cmd.UserID, account.Balance)
 
-	return true
+	return nil
 }
 
 // Gets a quote from the quoteserver
-func executeQuote(cmd commands.Command) bool {
+func executeQuote(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	// Get the stock from the command
 	stock := cmd.Args[0]
-	account := accountStore.GetAccount(cmd.UserID)
 
 	if stock == "" {
 		consoleLog.Error("No stock passed to QUOTE")
-		return false
+		return errMissingStock
 	}
 
 	// get a quote for the stock. (cache will determine if a fresh one is needed)
-	quote, err := quotecache.GetQuote(cmd.UserID, stock, cmd.ID)
+	quote, err := quoteCache.GetQuote(cmd.UserID, stock, cmd.ID)
 	if err != nil {
 		consoleLog.Error(err.Error())
-		return false
+		return err
 	}
 
 	consoleLog.Noticef("Got quote: %+v", quote)
-
-	//Check auto buy sell
-
-	for _, v := range (*autoBuyRequestStore)[stock] {
-		//fmt.Printf("key[%s] value[%s]\n", k, v)
-		if v.Trigger.ToFloat() <= quote.Price.ToFloat() {
-			//Fulfil buy action
-			wholeShares, cashRemainder := quote.Price.FitsInto(v.Amount)
-			if wholeShares == 0 {
-				continue
-			}
-			account.AddStockToPortfolio(stock, wholeShares)
-			account.AddFunds(cashRemainder)
-			consoleLog.Infof("Buy trigger fired for stock %s at price %s for user %s", stock, quote.Price, cmd.UserID)
-		}
-	}
-
-	for _, v := range (*autoSellRequestStore)[stock] {
-		//fmt.Printf("key[%s] value[%s]\n", k, v)
-		if v.Trigger.ToFloat() >= quote.Price.ToFloat() {
-			//Fulfil buy action
-			wholeShares, cashRemainder := quote.Price.FitsInto(v.Amount)
-			if !account.RemoveStockFromPortfolio(stock, wholeShares) {
-				consoleLog.Infof("User does not have enough stock to sell")
-				continue
-			}
-			v.Amount.Sub(cashRemainder)
-			account.AddFunds(v.Amount)
-			consoleLog.Infof("Sell trigger fired for stock %s at price %s for user %s", stock, quote.Price, cmd.UserID)
-		}
+	if quote.Stale {
+		consoleLog.Warningf("Quote for %s is stale; the quoteserver is unavailable", stock)
 	}
 
-	consoleLog.Noticef("Got quote: %+v", quote)
+	// Triggers the quote sets off are filled by triggerEngine once the
+	// command is done.
 
 	// send the quote to the user
-	return true
+	return nil
 }
 
-func executeBuy(cmd commands.Command) bool {
+func executeBuy(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	//Gotta check users money and add a reserved portion
-	account := accountStore.GetAccount(cmd.UserID)
+	account := work.Account(cmd.UserID)
 
 	if account == nil {
-		consoleLog.Noticef("User %s does not have an account", account)
-		return false
+		consoleLog.Noticef("User %s does not have an account", cmd.UserID)
+		return errNoAccount
 	}
 
 	stockSymbol := cmd.Args[0]
@@ -303,38 +653,45 @@ func executeBuy(cmd commands.Command) bool {
 
 	if err != nil {
 		consoleLog.Noticef("Dollar amount %s is invalid", cmd.Args[1])
-		return false
+		return errBadAmount
 	}
 	//User wants to buy y worth of x shares.
-	userQuote, err := quotecache.GetQuote(cmd.UserID, stockSymbol, cmd.ID)
+	userQuote, err := quoteCache.GetQuote(cmd.UserID, stockSymbol, cmd.ID)
 
 	if err != nil {
 		consoleLog.Noticef("Quote of stock %s for user %s is invalid", stockSymbol, cmd.UserID)
-		return false
+		return err
 	}
 
 	wholeShares, cashRemainder := userQuote.Price.FitsInto(dollarAmount)
 
 	if wholeShares == 0 {
 		consoleLog.Notice("Amount specified to buy less than single stock unit")
-		return true
+		return errLessThanOneShare
 	}
 
 	consoleLog.Infof("User %s set purchase order for %d shares of stock %s", cmd.UserID, wholeShares, stockSymbol)
 
-	// Remove the funds from user now to prevent double spending
+	// Reserve the funds now to prevent double spending
 	dollarAmount.Sub(cashRemainder)
-	account.RemoveFunds(dollarAmount)
+	reservationID, err := account.Reserve(dollarAmount, "BUY "+stockSymbol)
+	if err != nil {
+		consoleLog.Noticef("User %s has insufficient funds to buy %s of %s", cmd.UserID, dollarAmount, stockSymbol)
+		return errInsufficientFunds
+	}
+	logAccountTransaction(work, auditlogger.RemoveAction, cmd.UserID, dollarAmount, cmd.ID)
+
+	account.AddToBuyQueue(stockSymbol, wholeShares, userQuote.Price, reservationID)
 
-	return account.AddToBuyQueue(stockSymbol, wholeShares, userQuote.Price)
+	return nil
 }
 
-func executeCommitBuy(cmd commands.Command) bool {
-	account := accountStore.GetAccount(cmd.UserID)
+func executeCommitBuy(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+	account := work.Account(cmd.UserID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", cmd.UserID)
-		return false
+		return errNoAccount
 	}
 
 	// CommitBuy has no additional args to parse! Everything is in cmd.
@@ -344,28 +701,40 @@ func executeCommitBuy(cmd commands.Command) bool {
 
 	// If there's no Buy or it's expired, don't change the user account
 	// and log the command failure.
-	if !found || newestBuy.IsExpired() {
+	if !found {
 		consoleLog.Infof("No active buys to commit for %s", cmd.UserID)
-		return false
+		return errNoActiveBuy
+	} else if newestBuy.IsExpired() {
+		// Failing puts it back in the queue to be refunded by the sweep
+		consoleLog.Infof("Newest buy for %s has expired", cmd.UserID)
+		return errBuyExpired
+	}
+
+	// If there is an active Buy spend the reserved funds and
+	// give the user the stock quantity.
+	if _, err := account.SettleReservation(txFor(cmd), newestBuy.ReservationID, newestBuy.Cost()); err != nil {
+		consoleLog.Errorf("Couldn't settle buy for %s: %s", cmd.UserID, err.Error())
+		return err
 	}
 
-	// If there is an active Buy give the user the stock quantity.
 	consoleLog.Infof("Committing buy for user %s for %d unit of %s", cmd.UserID, newestBuy.Units, newestBuy.Stock)
 	consoleLog.Debugf("Before, user has %d of %s", account.GetPortfolioStockUnits(newestBuy.Stock), newestBuy.Stock)
 
-	account.AddStockToPortfolio(newestBuy.Stock, newestBuy.Units)
+	if err := account.BuyStock(txFor(cmd), newestBuy.Stock, accounts.Shares(newestBuy.Units), newestBuy.UnitPrice); err != nil {
+		return err
+	}
 
 	consoleLog.Debugf("After, user has %d of %s", account.GetPortfolioStockUnits(newestBuy.Stock), newestBuy.Stock)
 
-	return true
+	return nil
 }
 
-func executeCancelBuy(cmd commands.Command) bool {
-	account := accountStore.GetAccount(cmd.UserID)
+func executeCancelBuy(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+	account := work.Account(cmd.UserID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", cmd.UserID)
-		return false
+		return errNoAccount
 	}
 
 	// CommitBuy has no additional args to parse! Everything is in cmd.
@@ -374,30 +743,29 @@ func executeCancelBuy(cmd commands.Command) bool {
 	newestBuy, found := account.BuyQueue.PopNewest()
 	if !found {
 		consoleLog.Infof("No active buys to cancel for %s", cmd.UserID)
-		return false
+		return errNoActiveBuy
 	}
 
 	// Return the reserve amount to the user's balance
-	var reserve currency.Currency
-	reserve.Add(newestBuy.UnitPrice)
-	reserve.Mul(float64(newestBuy.Units))
+	reserve := newestBuy.Cost()
 
 	consoleLog.Infof("Cancel buy for %s. Adding back %s", newestBuy.Stock, reserve)
-	consoleLog.Debugf("Before, user balance %s", account.Balance)
+	consoleLog.Debugf("Before, user has %s available", account.Available())
 
-	account.AddFunds(reserve)
+	account.RefundBuy(newestBuy)
+	logAccountTransaction(work, auditlogger.AddAction, cmd.UserID, reserve, cmd.ID)
 
-	consoleLog.Debugf("After, user balance %s", account.Balance)
+	consoleLog.Debugf("After, user has %s available", account.Available())
 
-	return true
+	return nil
 }
 
-func executeSell(cmd commands.Command) bool {
-	account := accountStore.GetAccount(cmd.UserID)
+func executeSell(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+	account := work.Account(cmd.UserID)
 
 	if account == nil {
-		consoleLog.Noticef("User %s does not have an account", account)
-		return false
+		consoleLog.Noticef("User %s does not have an account", cmd.UserID)
+		return errNoAccount
 	}
 
 	stockSymbol := cmd.Args[0]
@@ -405,40 +773,42 @@ func executeSell(cmd commands.Command) bool {
 
 	if err != nil {
 		consoleLog.Noticef("Dollar amount %s is invalid", cmd.Args[1])
-		return false
+		return errBadAmount
 	}
 
-	userQuote, err := quotecache.GetQuote(cmd.UserID, stockSymbol, cmd.ID)
+	userQuote, err := quoteCache.GetQuote(cmd.UserID, stockSymbol, cmd.ID)
 
 	if err != nil {
 		consoleLog.Noticef("Quote of stock %s for user %s is invalid", stockSymbol, cmd.UserID)
-		return false
+		return err
 	}
 
 	wholeShares, _ := userQuote.Price.FitsInto(dollarAmount)
 
 	if wholeShares == 0 {
 		consoleLog.Notice("Amount specified to sell less than single stock unit")
-		return true
+		return errLessThanOneShare
 	}
 
 	consoleLog.Infof("User %s set sale order for %d shares of stock %s at %s", cmd.UserID, wholeShares, stockSymbol, userQuote.Price)
 
 	// Remove stock now to prevent double selling
-	if stockWasRemoved := account.RemoveStockFromPortfolio(stockSymbol, wholeShares); !stockWasRemoved {
-		return false
+	if err := account.RemoveStockFromPortfolio(txFor(cmd), stockSymbol, accounts.Shares(wholeShares)); err != nil {
+		return errInsufficientStock
 	}
 
 	// Make the new sell order and report success
-	return account.AddToSellQueue(stockSymbol, wholeShares, userQuote.Price)
+	account.AddToSellQueue(stockSymbol, wholeShares, userQuote.Price)
+
+	return nil
 }
 
-func executeCommitSell(cmd commands.Command) bool {
-	account := accountStore.GetAccount(cmd.UserID)
+func executeCommitSell(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+	account := work.Account(cmd.UserID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", cmd.UserID)
-		return false
+		return errNoAccount
 	}
 
 	// CommitSell has no additional args to parse! Everything is in cmd.
@@ -446,33 +816,38 @@ func executeCommitSell(cmd commands.Command) bool {
 	// Pop the latest Sell to get it out of the queue
 	newestSell, found := account.SellQueue.PopNewest()
 	if !found {
-		consoleLog.Infof("No active sells to cancel for %s", cmd.UserID)
-		return false
+		consoleLog.Infof("No active sells to commit for %s", cmd.UserID)
+		return errNoActiveSell
+	} else if newestSell.IsExpired() {
+		// Failing puts it back in the queue to be refunded by the sweep
+		consoleLog.Infof("Newest sell for %s has expired", cmd.UserID)
+		return errSellExpired
 	}
 
 	// Add the profit of the sale to the user's account
-	var profit currency.Currency
-	profit.Add(newestSell.UnitPrice)
-	profit.Mul(float64(newestSell.Units))
+	profit := newestSell.Cost()
 
 	consoleLog.Infof("Commit sell for %s of %d units of %s at %s. Adding %s",
 		cmd.UserID, newestSell.Units, newestSell.Stock, newestSell.UnitPrice, profit,
 	)
 	consoleLog.Debugf("Before, user balance %s", account.Balance)
 
-	account.AddFunds(profit)
+	account.AddFunds(txFor(cmd), profit)
+	pl := account.SellLots(newestSell.Stock, accounts.Shares(newestSell.Units), profit)
+	consoleLog.Infof("Realized %s on %s for %s", pl, newestSell.Stock, cmd.UserID)
+	logAccountTransaction(work, auditlogger.AddAction, cmd.UserID, profit, cmd.ID)
 
 	consoleLog.Debugf("After, user balance %s", account.Balance)
 
-	return true
+	return nil
 }
 
-func executeCancelSell(cmd commands.Command) bool {
-	account := accountStore.GetAccount(cmd.UserID)
+func executeCancelSell(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+	account := work.Account(cmd.UserID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", cmd.UserID)
-		return false
+		return errNoAccount
 	}
 
 	// CancelSell has no additional args to parse! Everything is in cmd.
@@ -480,203 +855,719 @@ func executeCancelSell(cmd commands.Command) bool {
 	newestSell, found := account.SellQueue.PopNewest()
 	if !found {
 		consoleLog.Infof("No active sells to cancel for %s", cmd.UserID)
-		return false
+		return errNoActiveSell
 	}
 
 	// Add the stock back to the user's portfolio
 	consoleLog.Infof("Cancel sell for %s. Adding back %d units", newestSell.Stock, newestSell.Units)
 	consoleLog.Debugf("Before, user portfolio: %d x %s", account.Portfolio[newestSell.Stock], newestSell.Stock)
 
-	account.AddStockToPortfolio(newestSell.Stock, newestSell.Units)
+	if err := account.AddStockToPortfolio(txFor(cmd), newestSell.Stock, accounts.Shares(newestSell.Units)); err != nil {
+		return err
+	}
 
 	consoleLog.Debugf("After, user portfolio: %d x %s", account.Portfolio[newestSell.Stock], newestSell.Stock)
 
-	return true
+	return nil
 }
 
-func executeSetBuyAmount(cmd commands.Command) bool {
+func executeSetBuyAmount(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	userID := cmd.UserID
 	strAmount := cmd.Args[1]
 	stock := cmd.Args[0]
-	account := accountStore.GetAccount(userID)
+	account := work.Account(userID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", userID)
-		return false
+		return errNoAccount
 	}
 
 	amount, err := currency.NewFromString(strAmount)
 	if err != nil {
 		consoleLog.Error("Failed to parse currency")
-		return false
+		return errBadAmount
 	}
-	err = account.RemoveFunds(amount)
+
+	previous, err := amountTargets(autoBuyRequestStore, stock, userID, optionalArg(cmd, 2), errNoAutoBuy)
 	if err != nil {
-		consoleLog.Errorf("User had insufficient funds to set buy amount of %s", amount)
-		return false
+		return err
 	}
-	autoBuyRequestStore.AddAutorequest(stock, cmd.UserID, amount)
-	consoleLog.Infof("User %s set automated buy amount for %s dollars of stock %s", userID, amount, stock)
-	return true
+
+	if len(previous) == 0 {
+		reservationID, err := reserveAutoBuyFunds(cmd, work, account, stock, amount)
+		if err != nil {
+			return err
+		}
+		transition, err := autoBuyRequestStore.AddAutorequest(stock, userID, cmd.ID, amount, reservationID)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, transition)
+		consoleLog.Infof("User %s set automated buy #%d for %s dollars of stock %s", userID, cmd.ID, amount, stock)
+		return nil
+	}
+
+	for _, autoBuy := range previous {
+		// Setting a new amount replaces the old one, so give back what
+		// the old one was holding. Failing keeps the previous amount and
+		// the funds it was holding.
+		releaseAutoBuyFunds(cmd, work, account, autoBuy)
+		reservationID, err := reserveAutoBuyFunds(cmd, work, account, stock, amount)
+		if err != nil {
+			return err
+		}
+		transition, err := autoBuyRequestStore.SetAmount(stock, userID, autoBuy.ID, amount, reservationID)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, transition)
+		consoleLog.Infof("User %s set automated buy #%d amount for %s dollars of stock %s", userID, autoBuy.ID, amount, stock)
+	}
+	return nil
 }
 
-func executeSetSellAmount(cmd commands.Command) bool {
+func executeSetSellAmount(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	userID := cmd.UserID
 	strAmount := cmd.Args[1]
 	stock := cmd.Args[0]
-	account := accountStore.GetAccount(userID)
+	account := work.Account(userID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", userID)
-		return false
+		return errNoAccount
 	}
 
 	amount, err := currency.NewFromString(strAmount)
 	if err != nil {
 		consoleLog.Error("Failed to parse currency")
-		return false
+		return errBadAmount
+	}
+
+	previous, err := amountTargets(autoSellRequestStore, stock, userID, optionalArg(cmd, 2), errNoAutoSell)
+	if err != nil {
+		return err
+	}
+
+	if len(previous) == 0 {
+		transition, err := autoSellRequestStore.AddAutorequest(stock, userID, cmd.ID, amount, accounts.NoReservation)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, transition)
+		consoleLog.Infof("User %s set automated sell #%d for %s dollars of stock %s", userID, cmd.ID, amount, stock)
+		return nil
+	}
+
+	for _, autoSell := range previous {
+		transition, err := autoSellRequestStore.SetAmount(stock, userID, autoSell.ID, amount, accounts.NoReservation)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, transition)
+		consoleLog.Infof("User %s set automated sell #%d amount for %s dollars of stock %s", userID, autoSell.ID, amount, stock)
+
+		// An armed sell holds enough shares for its amount. Failing keeps the
+		// previous amount and the shares it was holding.
+		if autoSell.State == autorequests.Armed {
+			if err := holdAutoSellShares(cmd, account, stock, autoSell.ID); err != nil {
+				return err
+			}
+		}
 	}
-	autoSellRequestStore.AddAutorequest(stock, userID, amount)
-	consoleLog.Infof("User %s set automated sell amount for %s dollars of stock %s", userID, amount, stock)
-	return true
+	return nil
 }
 
-func executeCancelSetBuy(cmd commands.Command) bool {
+func executeCancelSetBuy(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	userID := cmd.UserID
 	stock := cmd.Args[0]
-	account := accountStore.GetAccount(userID)
+	account := work.Account(userID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", userID)
-		return false
+		return errNoAccount
 	}
 
-	refundCurrency, err := autoBuyRequestStore.CancelAutorequest(stock, userID)
+	autoBuys, err := cancelTargets(autoBuyRequestStore, stock, userID, optionalArg(cmd, 1), errNoAutoBuy)
 	if err != nil {
 		consoleLog.Infof("Automated buy for stock %s was not found for user %s", stock, userID)
-	} else {
-		consoleLog.Infof("User %s cancelled automated buy for %s", userID, stock)
-		account.AddFunds(refundCurrency)
+		return err
+	}
+
+	for _, autoBuy := range autoBuys {
+		cancelled, err := autoBuyRequestStore.CancelAutorequest(stock, userID, autoBuy.ID)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, cancelled)
+
+		consoleLog.Infof("User %s cancelled automated buy #%d for %s", userID, autoBuy.ID, stock)
+		releaseAutoBuyFunds(cmd, work, account, cancelled.Request)
 	}
-	return true
+
+	return nil
 }
 
-func executeCancelSetSell(cmd commands.Command) bool {
+func executeCancelSetSell(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	userID := cmd.UserID
 	stock := cmd.Args[0]
-	account := accountStore.GetAccount(userID)
+	account := work.Account(userID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", userID)
-		return false
+		return errNoAccount
 	}
-	_, err := autoSellRequestStore.CancelAutorequest(stock, userID)
+
+	autoSells, err := cancelTargets(autoSellRequestStore, stock, userID, optionalArg(cmd, 1), errNoAutoSell)
 	if err != nil {
 		consoleLog.Infof("Automated sell for stock %s was not found for user %s", stock, userID)
-	} else {
-		//TODO, refund users stock.  We have to wait on the triggers for this
-		consoleLog.Infof("User %s cancelled automated sell for %s", userID, stock)
+		return err
 	}
-	return true
+
+	for _, autoSell := range autoSells {
+		cancelled, err := autoSellRequestStore.CancelAutorequest(stock, userID, autoSell.ID)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, cancelled)
+
+		consoleLog.Infof("User %s cancelled automated sell #%d for %s", userID, autoSell.ID, stock)
+		if err := releaseAutoSellShares(cmd, account, stock, cancelled.Request); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func executeSetBuyTrigger(cmd commands.Command) bool {
+func executeSetBuyTrigger(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	//Check that a sell amount exists in the store
 
 	userID := cmd.UserID
 	stock := cmd.Args[0]
 	strAmount := cmd.Args[1]
 
-	account := accountStore.GetAccount(userID)
+	account := work.Account(userID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", userID)
-		return false
+		return errNoAccount
 	}
 
 	stockTriggerCost, err := currency.NewFromString(strAmount)
 
-	if err != nil {
+	if err != nil || stockTriggerCost.ToFloat() == 0 {
 		consoleLog.Error("Failed to parse currency")
-		return false
+		return errBadAmount
 	}
 
-	userAutorequest, err := autoBuyRequestStore.GetAutorequest(stock, userID)
+	autoBuys, err := selectAutorequests(autoBuyRequestStore, stock, userID, optionalArg(cmd, 2), errNoAutoBuy)
 
 	if err != nil {
 		consoleLog.Infof("User %s does not have an auto request pending", userID)
-		return false
+		return err
 	}
 
-	stockTotalValue := userAutorequest.Amount
-
-	wholeShares, cashRemainder := stockTriggerCost.FitsInto(stockTotalValue)
-
-	if wholeShares == 0 {
-		consoleLog.Notice("Amount specified to buy less than single stock unit")
-		return true
-	}
+	for _, autoBuy := range autoBuys {
+		wholeShares, _ := stockTriggerCost.FitsInto(autoBuy.Amount)
 
-	consoleLog.Infof("User %s set purchase order for %d shares of stock %s", cmd.UserID, wholeShares, stock)
-
-	// Remove the funds from user now to prevent double spending
-	stockTotalValue.Sub(cashRemainder)
-	account.RemoveFunds(stockTotalValue)
+		if wholeShares == 0 {
+			consoleLog.Notice("Amount specified to buy less than single stock unit")
+			return errLessThanOneShare
+		}
 
-	userAutorequest.Trigger = stockTriggerCost
+		consoleLog.Infof("User %s set purchase order #%d for %d shares of stock %s", cmd.UserID, autoBuy.ID, wholeShares, stock)
 
-	// Add stocks to user portfolio
+		// The funds were reserved by SET_BUY_AMOUNT so there's nothing
+		// to take from the user here.
+		armed, err := autoBuyRequestStore.SetTrigger(stock, userID, autoBuy.ID, stockTriggerCost)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, armed)
+	}
 
-	return true
+	checkArmedTriggers(work, stock)
+	return nil
 }
 
-func executeSetSellTrigger(cmd commands.Command) bool {
+func executeSetSellTrigger(cmd commands.Command, work *unitofwork.UnitOfWork) error {
 	//Check that a sell amount exists in the store
 	userID := cmd.UserID
 	stock := cmd.Args[0]
 	strAmount := cmd.Args[1]
 
-	account := accountStore.GetAccount(userID)
+	account := work.Account(userID)
 
 	if account == nil {
 		consoleLog.Infof("User %s does not have an account", userID)
-		return false
+		return errNoAccount
 	}
 
 	stockTriggerCost, err := currency.NewFromString(strAmount)
 
-	if err != nil {
+	if err != nil || stockTriggerCost.ToFloat() == 0 {
 		consoleLog.Error("Failed to parse currency")
-		return false
+		return errBadAmount
 	}
 
-	userAutorequest, err := autoSellRequestStore.GetAutorequest(stock, userID)
+	autoSells, err := selectAutorequests(autoSellRequestStore, stock, userID, optionalArg(cmd, 2), errNoAutoSell)
 
 	if err != nil {
 		consoleLog.Infof("User %s does not have an auto request pending", userID)
-		return false
+		return err
+	}
+
+	for _, autoSell := range autoSells {
+		wholeShares, _ := stockTriggerCost.FitsInto(autoSell.Amount)
+
+		if wholeShares == 0 {
+			consoleLog.Notice("Amount specified to sell less than single stock unit")
+			return errLessThanOneShare
+		}
+
+		consoleLog.Infof("User %s set sell order #%d for %d shares of stock %s", cmd.UserID, autoSell.ID, wholeShares, stock)
+
+		armed, err := autoSellRequestStore.SetTrigger(stock, userID, autoSell.ID, stockTriggerCost)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, armed)
+
+		// Hold the shares now to prevent double selling. The user is paid
+		// when it's filled.
+		if err := holdAutoSellShares(cmd, account, stock, autoSell.ID); err != nil {
+			return err
+		}
+	}
+
+	checkArmedTriggers(work, stock)
+	return nil
+}
+
+func executeDumpLog(cmd commands.Command) error {
+	if len(cmd.Args) != 1 || cmd.Args[0] == "" {
+		consoleLog.Error("No filename passed to DUMPLOG")
+		return errMissingFilename
+	}
+	filename := cmd.Args[0]
+
+	// Admin dumps have no user and get everything
+	if cmd.UserID == "" {
+		consoleLog.Infof("Dumping audit log to %s", filename)
+		return auditlogger.DumpLog(filename)
+	}
+
+	consoleLog.Infof("Dumping audit log for %s to %s", cmd.UserID, filename)
+	return auditlogger.DumpUserLog(cmd.UserID, filename)
+}
+
+func executeDisplaySummary(cmd commands.Command) error {
+	account := accountStore.GetAccount(cmd.UserID)
+
+	if account == nil {
+		consoleLog.Infof("User %s does not have an account", cmd.UserID)
+		return errNoAccount
+	}
+
+	history, err := auditlogger.UserCommands(cmd.UserID)
+	if err != nil {
+		consoleLog.Errorf("Can't read the command history of %s: %s", cmd.UserID, err.Error())
+		return err
+	}
+
+	userSummary, err := summary.Build(
+		cmd.UserID, account,
+		autoBuyRequestStore, autoSellRequestStore,
+		history,
+		accountStore.Ledger.Query(accounts.LedgerQuery{UserID: cmd.UserID}),
+		latestPrices(account),
+	)
+	if err != nil {
+		consoleLog.Errorf("Can't summarize the account of %s: %s", cmd.UserID, err.Error())
+		return err
+	}
+
+	// Summaries are the command's result, so they're printed whatever the
+	// log level. The front end reads them one JSON object per line.
+	if *summaryFormat == "json" {
+		summaryJSON, err := json.Marshal(userSummary)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(summaryJSON))
+		return nil
+	}
+
+	fmt.Println(userSummary.String())
+	return nil
+}
+
+// The latest cached price of every stock the user holds lots of. Summaries
+// shouldn't cost a trip to the quote server.
+func latestPrices(account *accounts.Account) map[string]currency.Currency {
+	prices := make(map[string]currency.Currency)
+	for stock := range account.Lots {
+		if quote, found := quoteCache.LatestQuote(stock); found {
+			prices[stock] = quote.Price
+		}
+	}
+	return prices
+}
+
+// Checks every restored account and the system's total cash
+func runReconcile() {
+	consoleLog.Notice("Reconciling accounts")
+
+	violations := invariants.NewChecker(accountStore, autoBuyRequestStore, autoSellRequestStore).CheckAll()
+	reportViolations(violations)
+
+	if len(violations) == 0 {
+		consoleLog.Noticef("All %d accounts reconcile", len(accountStore.Names()))
+	} else {
+		consoleLog.Errorf("Found %d problems", len(violations))
+	}
+}
+
+// Writes each violation to the console and the audit log. The audit log
+// needs a transaction, so one that can't be blamed on any only goes to
+// the console.
+func reportViolations(violations []invariants.Violation) {
+	for _, v := range violations {
+		consoleLog.Errorf("Invariant violated! %s", v)
+		if v.TransactionNum > 0 {
+			auditlogger.LogViolation(v.TransactionNum, v.Command, v.UserID, v.Message)
+		}
+	}
+}
+
+// Buys shares for an automated buy that fired. The funds were reserved in
+// the owner's account by SET_BUY_AMOUNT.
+func fillBuyTrigger(fill autorequests.Fill) error {
+	return runFill(fill, func(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+		owner := work.Account(fill.UserID)
+		if owner == nil {
+			return errNoAccount
+		}
+
+		request, err := autoBuyRequestStore.GetAutorequest(fill.Stock, fill.UserID, fill.Request.ID)
+		if err != nil || request.State != autorequests.Armed {
+			// Filled or cancelled since it fired
+			return errNoAutoBuy
+		}
+
+		price := fill.Quote.Price
+		wholeShares, cashRemainder := price.FitsInto(request.Amount)
+		if wholeShares == 0 {
+			return errLessThanOneShare
+		}
+
+		spent := request.Amount
+		spent.Sub(cashRemainder)
+		leftover, err := owner.SettleReservation(txFor(cmd), request.ReservationID, spent)
+		if err != nil {
+			// Without its funds it can never be filled
+			expired, err := autoBuyRequestStore.ExpireAutorequest(fill.Stock, fill.UserID, request.ID)
+			if err != nil {
+				return err
+			}
+			logTransition(cmd, work, expired)
+			return nil
+		}
+
+		filled, err := autoBuyRequestStore.FillAutorequest(fill.Stock, fill.UserID, request.ID)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, filled)
+
+		if err := owner.BuyStock(txFor(cmd), fill.Stock, accounts.Shares(wholeShares), price); err != nil {
+			return err
+		}
+		logAccountTransaction(work, auditlogger.AddAction, fill.UserID, leftover, cmd.ID)
+		consoleLog.Infof("Bought %d %s for %s at %s", wholeShares, fill.Stock, fill.UserID, price)
+
+		return nil
+	})
+}
+
+// Sells shares for an automated sell that fired
+func fillSellTrigger(fill autorequests.Fill) error {
+	return runFill(fill, func(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+		owner := work.Account(fill.UserID)
+		if owner == nil {
+			return errNoAccount
+		}
+
+		request, err := autoSellRequestStore.GetAutorequest(fill.Stock, fill.UserID, fill.Request.ID)
+		if err != nil || request.State != autorequests.Armed {
+			// Filled or cancelled since it fired
+			return errNoAutoSell
+		}
+
+		if request.Units == 0 {
+			// Armed without holding shares, like sells saved before shares
+			// were held, so there's nothing to sell
+			return expireAutoSell(cmd, work, owner, fill.Stock, request)
+		}
+
+		filled, err := autoSellRequestStore.FillAutorequest(fill.Stock, fill.UserID, request.ID)
+		if err != nil {
+			return err
+		}
+		logTransition(cmd, work, filled)
+
+		// The shares were taken from the portfolio when it was armed
+		price := fill.Quote.Price
+		proceeds := price
+		proceeds.Mul(float64(request.Units))
+		owner.AddFunds(txFor(cmd), proceeds)
+		owner.SellLots(fill.Stock, request.Units, proceeds)
+		logAccountTransaction(work, auditlogger.AddAction, fill.UserID, proceeds, cmd.ID)
+		consoleLog.Infof("Sold %d %s for %s at %s", request.Units, fill.Stock, fill.UserID, price)
+
+		return nil
+	})
+}
+
+// Runs a fill as its own transaction. Like a command, its changes are all
+// kept or, if it fails, all undone.
+func runFill(fill autorequests.Fill, execute func(commands.Command, *unitofwork.UnitOfWork) error) error {
+	cmd := commands.Command{
+		ID:     fill.TransactionNum,
+		Name:   fill.Command,
+		UserID: fill.UserID,
+		Args:   []string{fill.Stock, accounts.FormatMoney(fill.Request.Amount)},
 	}
 
-	stockTotalValue := userAutorequest.Amount
+	work := unitofwork.Begin(accountStore, autoBuyRequestStore, autoSellRequestStore)
 
-	wholeShares, cashRemainder := stockTriggerCost.FitsInto(stockTotalValue)
+	if err := execute(cmd, work); err != nil {
+		work.Rollback()
+		auditlogger.LogError(cmd, err.Error())
+		return err
+	}
 
+	work.Commit()
+	return nil
+}
+
+// Undoes the user's expired Buys and Sells. The refunds are audited
+// against the command that noticed they had expired.
+func sweepExpired(cmd commands.Command) {
+	work := unitofwork.Begin(accountStore, autoBuyRequestStore, autoSellRequestStore)
+	defer work.Commit()
+
+	account := work.Account(cmd.UserID)
+	if account == nil {
+		return
+	}
+
+	for _, expiredBuy := range account.ExpireBuys() {
+		consoleLog.Infof("Buy of %d %s for %s expired. Refunding %s",
+			expiredBuy.Units, expiredBuy.Stock, cmd.UserID, expiredBuy.Cost(),
+		)
+		logAccountTransaction(work, auditlogger.AddAction, cmd.UserID, expiredBuy.Cost(), cmd.ID)
+		logExpiredAction(cmd, work, commands.Buy, expiredBuy)
+	}
+
+	for _, expiredSell := range account.ExpireSells(txFor(cmd)) {
+		consoleLog.Infof("Sell of %d %s for %s expired. Returning shares",
+			expiredSell.Units, expiredSell.Stock, cmd.UserID,
+		)
+		logExpiredAction(cmd, work, commands.Sell, expiredSell)
+	}
+}
+
+// Records that the system undid a Buy or Sell as a systemEvent
+func logExpiredAction(cmd commands.Command, work *unitofwork.UnitOfWork, name commands.CommandType, expired accounts.Action) {
+	event := commands.Command{
+		ID:     cmd.ID,
+		Name:   name,
+		UserID: cmd.UserID,
+		Args:   []string{expired.Stock, accounts.FormatMoney(expired.Cost())},
+	}
+	work.OnCommit(func() { auditlogger.LogSystemEvent(event) })
+}
+
+// Audits a change to a user's funds once the work it's part of is kept
+func logAccountTransaction(
+	work *unitofwork.UnitOfWork, action, userID string, amount currency.Currency, transactionNum int,
+) {
+	work.OnCommit(func() {
+		auditlogger.LogAccountTransaction(action, userID, amount, transactionNum)
+	})
+}
+
+// Audits a trigger changing state once the work it's part of is kept. The
+// systemEvent names the command that moved it; a debugEvent says where to.
+func logTransition(cmd commands.Command, work *unitofwork.UnitOfWork, t autorequests.Transition) {
+	event := commands.Command{
+		ID:     cmd.ID,
+		Name:   cmd.Name,
+		UserID: t.UserID,
+		Args:   []string{t.Stock, accounts.FormatMoney(t.Request.Amount)},
+	}
+	work.OnCommit(func() {
+		consoleLog.Infof("Trigger %s", t)
+		auditlogger.LogSystemEvent(event)
+		auditlogger.LogDebugEvent(event, "trigger "+t.String())
+	})
+}
+
+// Checks the stock's triggers against its cached price once the work is
+// kept, so one armed past the price fires without waiting for the next
+// quote. An expired price is left for the poller or the next QUOTE.
+func checkArmedTriggers(work *unitofwork.UnitOfWork, stock string) {
+	quote, found := quoteCache.LatestQuote(stock)
+	if !found || quote.IsExpired() {
+		return
+	}
+	work.OnCommit(func() { triggerEngine.PriceUpdated(quote) })
+}
+
+// Holds amount in the user's account for an automated buy
+func reserveAutoBuyFunds(
+	cmd commands.Command, work *unitofwork.UnitOfWork, account *accounts.Account, stock string, amount currency.Currency,
+) (accounts.ReservationID, error) {
+	reservationID, err := account.Reserve(amount, "SET_BUY_AMOUNT "+stock)
+	if err != nil {
+		consoleLog.Errorf("User had insufficient funds to set buy amount of %s", amount)
+		return accounts.NoReservation, errInsufficientFunds
+	}
+	logAccountTransaction(work, auditlogger.RemoveAction, cmd.UserID, amount, cmd.ID)
+	return reservationID, nil
+}
+
+// Gives back the funds an automated buy was holding
+func releaseAutoBuyFunds(cmd commands.Command, work *unitofwork.UnitOfWork, account *accounts.Account, autoBuy autorequests.AutoRequest) {
+	released, err := account.ReleaseReservation(autoBuy.ReservationID)
+	if err != nil {
+		// Already filled
+		return
+	}
+	logAccountTransaction(work, auditlogger.AddAction, cmd.UserID, released, cmd.ID)
+}
+
+// Takes the shares the user's armed sell needs at its trigger price from
+// their portfolio, giving back any it was already holding
+func holdAutoSellShares(cmd commands.Command, account *accounts.Account, stock string, id int) error {
+	autoSell, err := autoSellRequestStore.GetAutorequest(stock, cmd.UserID, id)
+	if err != nil {
+		return errNoAutoSell
+	}
+	if err := releaseAutoSellShares(cmd, account, stock, autoSell); err != nil {
+		return err
+	}
+
+	wholeShares, _ := autoSell.Trigger.FitsInto(autoSell.Amount)
 	if wholeShares == 0 {
-		consoleLog.Notice("Amount specified to buy less than single stock unit")
-		return true
+		return errLessThanOneShare
+	}
+	units := accounts.Shares(wholeShares)
+
+	if err := account.RemoveStockFromPortfolio(txFor(cmd), stock, units); err != nil {
+		consoleLog.Infof("User %s has fewer than %d shares of %s to hold", cmd.UserID, units, stock)
+		return errInsufficientStock
+	}
+
+	return autoSellRequestStore.HoldShares(stock, cmd.UserID, id, units)
+}
+
+// Retires an automated sell that can never be filled, giving back the
+// shares it was holding
+func expireAutoSell(
+	cmd commands.Command, work *unitofwork.UnitOfWork, account *accounts.Account, stock string, autoSell autorequests.AutoRequest,
+) error {
+	expired, err := autoSellRequestStore.ExpireAutorequest(stock, cmd.UserID, autoSell.ID)
+	if err != nil {
+		return err
+	}
+	logTransition(cmd, work, expired)
+	return releaseAutoSellShares(cmd, account, stock, expired.Request)
+}
+
+// Gives back the shares an automated sell was holding
+func releaseAutoSellShares(cmd commands.Command, account *accounts.Account, stock string, autoSell autorequests.AutoRequest) error {
+	if autoSell.Units == 0 {
+		return nil
 	}
+	return account.AddStockToPortfolio(txFor(cmd), stock, autoSell.Units)
+}
 
-	consoleLog.Infof("User %s set purchase order for %d shares of stock %s", cmd.UserID, wholeShares, stock)
+// The user's requests for stock that a trigger command is about. arg is a
+// request ID, "all", or "" for the newest one, which is what commands
+// meant when a user could only have one.
+func selectAutorequests(
+	store *autorequests.AutoRequestStore, stock, userID, arg string, notFound error,
+) ([]autorequests.AutoRequest, error) {
+	switch strings.ToLower(arg) {
+	case "":
+		latest, err := store.LatestAutorequest(stock, userID)
+		if err != nil {
+			return nil, notFound
+		}
+		return []autorequests.AutoRequest{latest}, nil
+	case "all":
+		requests := store.GetUserAutorequests(userID)[stock]
+		if len(requests) == 0 {
+			return nil, notFound
+		}
+		return requests, nil
+	}
+
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, errBadTriggerID
+	}
+	request, err := store.GetAutorequest(stock, userID, id)
+	if err != nil {
+		return nil, notFound
+	}
+	return []autorequests.AutoRequest{request}, nil
+}
 
-	// Remove the funds from user now to prevent double spending
-	stockTotalValue.Sub(cashRemainder)
-	account.AddFunds(stockTotalValue)
+// The user's requests for stock that SET_*_AMOUNT changes. arg is a
+// request ID, "all", "new" to start another request, or "" for the
+// newest, armed or not, which changes the one request a user could have
+// before. With none, a new request is started.
+func amountTargets(
+	store *autorequests.AutoRequestStore, stock, userID, arg string, notFound error,
+) ([]autorequests.AutoRequest, error) {
+	switch strings.ToLower(arg) {
+	case "new":
+		return nil, nil
+	case "":
+		latest, err := store.LatestAutorequest(stock, userID)
+		if err != nil {
+			return nil, nil
+		}
+		return []autorequests.AutoRequest{latest}, nil
+	}
 
-	userAutorequest.Trigger = stockTriggerCost
+	return selectAutorequests(store, stock, userID, arg, notFound)
+}
 
-	// Remove stocks from user portfolio
+// The user's requests for stock that CANCEL_SET_* cancels. Without an ID
+// it's all of them, so cancelling still releases everything the user had
+// set aside for the stock, like when a user could only have one request.
+func cancelTargets(
+	store *autorequests.AutoRequestStore, stock, userID, arg string, notFound error,
+) ([]autorequests.AutoRequest, error) {
+	if arg == "" {
+		arg = "all"
+	}
+	return selectAutorequests(store, stock, userID, arg, notFound)
+}
 
-	account.RemoveStockFromPortfolio(stock, wholeShares)
+// cmd's i-th argument, or "" if it wasn't given
+func optionalArg(cmd commands.Command, i int) string {
+	if i < len(cmd.Args) {
+		return cmd.Args[i]
+	}
+	return ""
+}
 
-	return true
+// The transaction that account changes made by cmd belong to
+func txFor(cmd commands.Command) accounts.Tx {
+	return accounts.Tx{ID: cmd.ID, Command: cmd.Name}
 }
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/auditlogger"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/persist"
+	"github.com/distributeddesigns/milestone1/quotecache"
+	"github.com/distributeddesigns/milestone1/repository"
+	"github.com/distributeddesigns/milestone1/unitofwork"
+)
+
+// TestMain : Runs the tests in a scratch directory so the audit log they
+// write to ./logs is thrown away
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "milestone1")
+	if err != nil {
+		panic(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+
+	*logLevel = "CRITICAL"
+	consoleLoggingInit()
+	closeAuditLogger := auditlogger.Init()
+
+	code := m.Run()
+
+	closeAuditLogger()
+	os.Chdir(cwd)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newAlice : Fresh stores where alice has $1000.00 and 10 ABC bought in
+// two lots. Quotes for ABC are $4.00 until a test says otherwise.
+func newAlice(t *testing.T) {
+	accountStore = accounts.NewAccountStore()
+	autoBuyRequestStore = autorequests.NewAutoRequestStore()
+	autoSellRequestStore = autorequests.NewAutoRequestStore()
+	quoteCache = quotecache.NewCache(quotecache.NewFakeQuoteSource(
+		map[string]currency.Currency{"ABC": testutil.Money(t, "4.00")}, 1,
+	))
+	triggerEngine = autorequests.NewEngine(
+		autoBuyRequestStore, autoSellRequestStore,
+		fillBuyTrigger, fillSellTrigger,
+		1000000000,
+	)
+	triggerEngine.Subscribe(quoteCache)
+
+	run(t, "[1] ADD,alice,1000.00")
+	alice := accountStore.GetAccount("alice")
+	tx := accounts.Tx{ID: 1, Command: commands.CommitBuy}
+	if err := alice.BuyStock(tx, "ABC", 6, testutil.Money(t, "2.00")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.BuyStock(tx, "ABC", 4, testutil.Money(t, "3.00")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// run : Executes a workload line and fills anything it set off. Fails the
+// test if the command fails.
+func run(t *testing.T, line string) {
+	if err := runCommand(line); err != nil {
+		t.Fatalf("%s: %s", line, err.Error())
+	}
+}
+
+func runCommand(line string) error {
+	err := executeCommand(parseCommand(line))
+	triggerEngine.RunPending()
+	return err
+}
+
+// holdings : The parts of an account that held shares come out of
+type holdings struct {
+	Portfolio accounts.Portfolio
+	Lots      map[string][]accounts.Lot
+}
+
+// aliceHoldings : alice's holdings now. Her account is looked up every
+// time because a rollback replaces it.
+func aliceHoldings() holdings {
+	s := accountStore.GetAccount("alice").Snapshot()
+	return holdings{s.Portfolio, s.Lots}
+}
+
+func checkHoldings(t *testing.T, when string, want holdings) {
+	if got := aliceHoldings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: holdings are\n%+v\nwant\n%+v", when, got, want)
+	}
+}
+
+func checkUnits(t *testing.T, when string, want accounts.Shares) {
+	if got := accountStore.GetAccount("alice").GetPortfolioStockUnits("ABC"); got != want {
+		t.Errorf("%s: portfolio holds %d ABC, want %d", when, got, want)
+	}
+}
+
+// checkNoSells : alice has no automated sells left
+func checkNoSells(t *testing.T, when string) {
+	if sells := autoSellRequestStore.GetUserAutorequests("alice"); len(sells) != 0 {
+		t.Errorf("%s: alice still has automated sells %+v", when, sells)
+	}
+}
+
+func TestCancelBeforeArmingReturnsNothing(t *testing.T) {
+	newAlice(t)
+	before := aliceHoldings()
+
+	run(t, "[2] SET_SELL_AMOUNT,alice,ABC,20.00")
+	checkHoldings(t, "after SET_SELL_AMOUNT", before)
+
+	run(t, "[3] CANCEL_SET_SELL,alice,ABC")
+	checkHoldings(t, "after CANCEL_SET_SELL", before)
+	checkNoSells(t, "after CANCEL_SET_SELL")
+}
+
+func TestCancelAfterArmingReturnsHeldShares(t *testing.T) {
+	newAlice(t)
+	before := aliceHoldings()
+
+	run(t, "[2] SET_SELL_AMOUNT,alice,ABC,20.00")
+	run(t, "[3] SET_SELL_TRIGGER,alice,ABC,5.00")
+	checkUnits(t, "after SET_SELL_TRIGGER", 6)
+
+	// Moving the trigger holds a different number of shares, not more
+	run(t, "[4] SET_SELL_TRIGGER,alice,ABC,10.00")
+	checkUnits(t, "after moving the trigger", 8)
+
+	run(t, "[5] CANCEL_SET_SELL,alice,ABC")
+	checkHoldings(t, "after CANCEL_SET_SELL", before)
+	checkNoSells(t, "after CANCEL_SET_SELL")
+}
+
+func TestCancelAllReturnsEveryTriggersShares(t *testing.T) {
+	newAlice(t)
+	before := aliceHoldings()
+
+	run(t, "[2] SET_SELL_AMOUNT,alice,ABC,20.00")
+	run(t, "[3] SET_SELL_TRIGGER,alice,ABC,5.00")
+	run(t, "[4] SET_SELL_AMOUNT,alice,ABC,12.00,new")
+	run(t, "[5] SET_SELL_TRIGGER,alice,ABC,6.00")
+	checkUnits(t, "with two armed sells", 4)
+
+	run(t, "[6] CANCEL_SET_SELL,alice,ABC,all")
+	checkHoldings(t, "after CANCEL_SET_SELL", before)
+	checkNoSells(t, "after CANCEL_SET_SELL")
+}
+
+// checkReserved : alice has exactly want set aside for automated buys
+func checkReserved(t *testing.T, when, want string) {
+	if got := accountStore.GetAccount("alice").Reserved(); got.String() != testutil.Money(t, want).String() {
+		t.Errorf("%s: alice has %s reserved, want %s", when, got, want)
+	}
+}
+
+func TestSetAmountWithoutAnIDChangesTheArmedTrigger(t *testing.T) {
+	newAlice(t)
+
+	run(t, "[2] SET_BUY_AMOUNT,alice,ABC,50.00")
+	run(t, "[3] SET_BUY_TRIGGER,alice,ABC,3.00")
+	run(t, "[4] SET_BUY_AMOUNT,alice,ABC,80.00")
+
+	buys := autoBuyRequestStore.GetUserAutorequests("alice")["ABC"]
+	if len(buys) != 1 || buys[0].ID != 2 || buys[0].State != autorequests.Armed || buys[0].Amount.String() != testutil.Money(t, "80.00").String() {
+		t.Fatalf("buys are %+v, want #2 armed for $80.00", buys)
+	}
+	checkReserved(t, "after changing the amount", "80.00")
+
+	// Another trigger has to be asked for
+	run(t, "[5] SET_BUY_AMOUNT,alice,ABC,20.00,new")
+	if buys := autoBuyRequestStore.GetUserAutorequests("alice")["ABC"]; len(buys) != 2 {
+		t.Fatalf("%d buys after SET_BUY_AMOUNT with new, want 2", len(buys))
+	}
+	checkReserved(t, "after starting another trigger", "100.00")
+}
+
+func TestCancelWithoutAnIDReleasesEveryTrigger(t *testing.T) {
+	newAlice(t)
+
+	run(t, "[2] SET_BUY_AMOUNT,alice,ABC,50.00")
+	run(t, "[3] SET_BUY_TRIGGER,alice,ABC,3.00")
+	run(t, "[4] SET_BUY_AMOUNT,alice,ABC,30.00,new")
+	checkReserved(t, "with two buys", "80.00")
+
+	run(t, "[5] CANCEL_SET_BUY,alice,ABC")
+	if buys := autoBuyRequestStore.GetUserAutorequests("alice"); len(buys) != 0 {
+		t.Errorf("alice still has automated buys %+v", buys)
+	}
+	checkReserved(t, "after CANCEL_SET_BUY", "0.00")
+}
+
+func TestFillSellsOnlyHeldShares(t *testing.T) {
+	newAlice(t)
+	balance := accountStore.GetAccount("alice").Balance
+
+	run(t, "[2] SET_SELL_AMOUNT,alice,ABC,20.00")
+	run(t, "[3] SET_SELL_TRIGGER,alice,ABC,5.00")
+	held := aliceHoldings()
+
+	filled := triggerEngine.Evaluate(quotecache.Quote{Stock: "ABC", Price: testutil.Money(t, "6.00"), Timestamp: time.Now()})
+	if len(filled) != 1 {
+		t.Fatalf("%d triggers filled, want 1", len(filled))
+	}
+
+	// The 4 held shares were sold. The portfolio was already without them.
+	alice := accountStore.GetAccount("alice")
+	checkUnits(t, "after the fill", 6)
+	if !reflect.DeepEqual(alice.Portfolio, held.Portfolio) {
+		t.Errorf("fill changed the portfolio from %v to %v", held.Portfolio, alice.Portfolio)
+	}
+	wantLots := []accounts.Lot{held.Lots["ABC"][0], held.Lots["ABC"][1]}
+	wantLots[0].Units = 2
+	if !reflect.DeepEqual(alice.Lots["ABC"], wantLots) {
+		t.Errorf("lots after the fill are %+v, want %+v", alice.Lots["ABC"], wantLots)
+	}
+	balance.Add(testutil.Money(t, "24.00"))
+	if alice.Balance.String() != balance.String() {
+		t.Errorf("balance after the fill is %s, want %s", alice.Balance, balance)
+	}
+	checkNoSells(t, "after the fill")
+
+	// Filled triggers can't be cancelled for their shares again
+	if err := runCommand("[4] CANCEL_SET_SELL,alice,ABC"); err == nil {
+		t.Error("cancelled a filled trigger")
+	}
+	checkUnits(t, "after cancelling a filled trigger", 6)
+}
+
+func TestExpiringAFailedFillReturnsHeldShares(t *testing.T) {
+	newAlice(t)
+	before := aliceHoldings()
+
+	// An armed sell that holds nothing, as one saved before shares were
+	// held would, can't be filled
+	if _, err := autoSellRequestStore.AddAutorequest("ABC", "alice", 2, testutil.Money(t, "20.00"), accounts.NoReservation); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := autoSellRequestStore.SetTrigger("ABC", "alice", 2, testutil.Money(t, "5.00")); err != nil {
+		t.Fatal(err)
+	}
+	triggerEngine.Evaluate(quotecache.Quote{Stock: "ABC", Price: testutil.Money(t, "6.00"), Timestamp: time.Now()})
+	checkHoldings(t, "after the failed fill", before)
+	checkNoSells(t, "after the failed fill")
+
+	// One holding shares gives them all back when it expires
+	run(t, "[3] SET_SELL_AMOUNT,alice,ABC,20.00")
+	run(t, "[4] SET_SELL_TRIGGER,alice,ABC,5.00")
+	checkUnits(t, "after SET_SELL_TRIGGER", 6)
+
+	armed, err := autoSellRequestStore.GetAutorequest("ABC", "alice", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := autorequests.Fill{TransactionNum: triggerEngine.TakeTransaction(), Command: commands.Sell, Stock: "ABC", UserID: "alice", Request: armed}
+	err = runFill(fill, func(cmd commands.Command, work *unitofwork.UnitOfWork) error {
+		return expireAutoSell(cmd, work, work.Account("alice"), "ABC", armed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHoldings(t, "after expiring", before)
+	checkNoSells(t, "after expiring")
+}
+
+func TestRollbackReturnsHeldShares(t *testing.T) {
+	newAlice(t)
+	before := aliceHoldings()
+
+	run(t, "[2] SET_SELL_AMOUNT,alice,ABC,30.00")
+	run(t, "[3] SET_SELL_TRIGGER,alice,ABC,5.00")
+	run(t, "[4] SET_SELL_AMOUNT,alice,ABC,20.00,new")
+	held := aliceHoldings()
+	checkUnits(t, "with one armed sell", 4)
+
+	trigger := testutil.Money(t, "5.00").String()
+	checkSells := func(when string) {
+		sells := autoSellRequestStore.GetUserAutorequests("alice")["ABC"]
+		if len(sells) != 2 ||
+			sells[0].State != autorequests.Armed || sells[0].Units != 6 || sells[0].Trigger.String() != trigger ||
+			sells[1].State != autorequests.AmountSet || sells[1].Units != 0 {
+			t.Errorf("%s: sells are %+v, want #2 armed at $5.00 holding 6 and #4 unarmed", when, sells)
+		}
+	}
+
+	// Moving #2 down to $3.00 holds all 10 shares, leaving none for #4,
+	// so the command fails and #2 goes back to holding 6
+	if err := runCommand("[5] SET_SELL_TRIGGER,alice,ABC,3.00,all"); err != errInsufficientStock {
+		t.Fatalf("arming both returned %v, want %v", err, errInsufficientStock)
+	}
+	checkHoldings(t, "after the failed SET_SELL_TRIGGER", held)
+	checkSells("after the failed SET_SELL_TRIGGER")
+
+	// Raising an armed sell's amount past the shares keeps what it held
+	if err := runCommand("[6] SET_SELL_AMOUNT,alice,ABC,100.00,2"); err != errInsufficientStock {
+		t.Fatalf("raising the amount returned %v, want %v", err, errInsufficientStock)
+	}
+	checkHoldings(t, "after the failed SET_SELL_AMOUNT", held)
+	checkSells("after the failed SET_SELL_AMOUNT")
+
+	run(t, "[7] CANCEL_SET_SELL,alice,ABC,all")
+	checkHoldings(t, "after cancelling", before)
+	checkNoSells(t, "after cancelling")
+}
+
+// TestExpiringFillsAreSaved : Fills that expire a trigger make no ledger
+// entry. The trigger's owner is saved anyway, so it doesn't come back
+// armed after a restart.
+func TestExpiringFillsAreSaved(t *testing.T) {
+	newAlice(t)
+
+	dir, err := ioutil.TempDir("", "milestone1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal, err := persist.Open(dir, persist.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo = journal
+	defer func() { repo = nil }()
+
+	for _, line := range []string{
+		"[2] ADD,bob,10.00",
+		"[3] SET_BUY_AMOUNT,alice,ABC,50.00",
+		"[4] SET_BUY_TRIGGER,alice,ABC,5.00",
+		"[5] SET_SELL_AMOUNT,alice,ABC,8.00",
+		"[6] SET_SELL_TRIGGER,alice,ABC,3.00",
+	} {
+		runWorkloadCommand(parseCommand(line))
+	}
+
+	// The buy loses its funds and the sell its shares, so neither can be
+	// filled when bob's quote sets them off
+	autoBuy, err := autoBuyRequestStore.LatestAutorequest("ABC", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accountStore.GetAccount("alice").ReleaseReservation(autoBuy.ReservationID); err != nil {
+		t.Fatal(err)
+	}
+	if err := autoSellRequestStore.HoldShares("ABC", "alice", 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	runWorkloadCommand(parseCommand("[7] QUOTE,bob,ABC"))
+	if buys, sells := autoBuyRequestStore.GetUserAutorequests("alice"), autoSellRequestStore.GetUserAutorequests("alice"); len(buys)+len(sells) != 0 {
+		t.Fatalf("alice's triggers didn't expire: buys %+v, sells %+v", buys, sells)
+	}
+
+	// Restart
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if journal, err = persist.Open(dir, persist.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	autoBuys, autoSells := autorequests.NewAutoRequestStore(), autorequests.NewAutoRequestStore()
+	lastTransaction, _, err := repository.Load(journal, accounts.NewAccountStore(), autoBuys, autoSells)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastTransaction != 7 {
+		t.Errorf("restored up to transaction %d, want 7", lastTransaction)
+	}
+	if buys := autoBuys.GetUserAutorequests("alice"); len(buys) != 0 {
+		t.Errorf("expired buys came back: %+v", buys)
+	}
+	if sells := autoSells.GetUserAutorequests("alice"); len(sells) != 0 {
+		t.Errorf("expired sells came back: %+v", sells)
+	}
+}
@@ -1,15 +1,30 @@
 package auditlogger
 
 import (
+	"bytes"
+	"encoding/xml"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/distributeddesigns/currency"
 	"github.com/distributeddesigns/milestone1/commands"
 	logging "github.com/op/go-logging"
 )
 
-const outdir string = "logs"
+const (
+	outdir string = "logs"
+
+	logHeader = "<?xml version=\"1.0\"?>\n<log>\n"
+	logFooter = "\n</log>\n"
+)
+
+// Valid values for the <action> field of an accountTransaction
+const (
+	AddAction    = "add"
+	RemoveAction = "remove"
+)
 
 var (
 	auditlogFile *os.File
@@ -22,12 +37,7 @@ var (
 //  	Returns a callback that will write the XML footer and close the
 //		file reference.
 func Init() func() {
-	// Get a server name from the environment
-	if os.Getenv("SERVERNAME") == "" {
-		servername = "UNKNOWN"
-	} else {
-		servername = os.Getenv("SERVERNAME")
-	}
+	setServername()
 
 	// Create a new file based on the current time
 	now := time.Now()
@@ -56,23 +66,160 @@ func Init() func() {
 	}
 	// closing the audit file is the responsiblity of the caller to Init()
 
-	// Write our logfile header
-	auditlogFile.WriteString("<?xml version=\"1.0\"?>\n<log>\n")
+	// Write our logfile header. Events start after it.
+	n, _ := auditlogFile.WriteString(logHeader)
+	resetIndex(int64(n))
+
+	return closeAuditFile
+}
+
+// Resume : Like Init, but logs to filename, carrying on after the events
+// already in it so DUMPLOG and DISPLAY_SUMMARY still cover them. The
+// file is started if it doesn't exist.
+func Resume(filename string) (func(), error) {
+	setServername()
 
-	// Return an anonymous function that creates a closure over the audit file.
-	// If we defered File.Close() in Init() we'd close the audit file
-	// as soon as Init() finished.
-	return func() {
-		auditlogFile.WriteString("\n</log>\n")
-		auditlogFile.Close()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := indexEvents(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	auditlogFile = file
+
+	return closeAuditFile, nil
+}
+
+// closeAuditFile : Writes the XML footer and closes the audit file. Init
+// and Resume hand it back rather than deferring it themselves, which
+// would close the file as soon as they returned.
+func closeAuditFile() {
+	auditlogMutex.Lock()
+	defer auditlogMutex.Unlock()
+
+	auditlogFile.WriteString(logFooter)
+	auditlogFile.Close()
+}
+
+// setServername : Get a server name from the environment
+func setServername() {
+	if os.Getenv("SERVERNAME") == "" {
+		servername = "UNKNOWN"
+	} else {
+		servername = os.Getenv("SERVERNAME")
 	}
 }
 
 // LogCommand : Writes a UserCommandType to the audit log
 func LogCommand(cmd commands.Command) {
-	// Parse the optional fields. Initialized to "" which is the default case.
-	var usernameField, stockField, fileField, fundsField string
+	usernameField, stockField, fileField, fundsField := commandFields(cmd)
+
+	xmlElement := fmt.Sprintf(`
+	<userCommand>
+		<timestamp>%d</timestamp>
+		<server>%s</server>
+		<transactionNum>%d</transactionNum>
+		<command>%s</command>%s%s%s%s
+	</userCommand>`,
+		nowInMillisec(), servername, cmd.ID, cmd.Name,
+		usernameField, stockField, fileField, fundsField,
+	)
 
+	writeCommand(cmd.UserID, xmlElement)
+}
+
+// LogError : Writes an ErrorEventType to the audit log. The optional fields
+// are taken from the failed command and message explains why it failed.
+func LogError(cmd commands.Command, message string) {
+	usernameField, stockField, fileField, fundsField := commandFields(cmd)
+
+	xmlElement := fmt.Sprintf(`
+	<errorEvent>
+		<timestamp>%d</timestamp>
+		<server>%s</server>
+		<transactionNum>%d</transactionNum>
+		<command>%s</command>%s%s%s%s%s
+	</errorEvent>`,
+		nowInMillisec(), servername, cmd.ID, cmd.Name,
+		usernameField, stockField, fileField, fundsField,
+		formatErrorMessage(message),
+	)
+
+	writeEvent(cmd.UserID, xmlElement)
+}
+
+// LogViolation : Writes an ErrorEventType for a broken account invariant.
+// transactionNum and command identify the transaction that broke it.
+// userID is "" for problems with the system as a whole.
+func LogViolation(transactionNum int, command commands.CommandType, userID, message string) {
+	var usernameField string
+	if userID != "" {
+		usernameField = formatUsername(userID)
+	}
+
+	xmlElement := fmt.Sprintf(`
+	<errorEvent>
+		<timestamp>%d</timestamp>
+		<server>%s</server>
+		<transactionNum>%d</transactionNum>
+		<command>%s</command>%s%s
+	</errorEvent>`,
+		nowInMillisec(), servername, transactionNum, command,
+		usernameField, formatErrorMessage(message),
+	)
+
+	writeEvent(userID, xmlElement)
+}
+
+// LogSystemEvent : Writes a SystemEventType to the audit log. Used for things
+// the system does on its own, like expiring a Buy, described as a command.
+func LogSystemEvent(cmd commands.Command) {
+	usernameField, stockField, fileField, fundsField := commandFields(cmd)
+
+	xmlElement := fmt.Sprintf(`
+	<systemEvent>
+		<timestamp>%d</timestamp>
+		<server>%s</server>
+		<transactionNum>%d</transactionNum>
+		<command>%s</command>%s%s%s%s
+	</systemEvent>`,
+		nowInMillisec(), servername, cmd.ID, cmd.Name,
+		usernameField, stockField, fileField, fundsField,
+	)
+
+	writeEvent(cmd.UserID, xmlElement)
+}
+
+// LogDebugEvent : Writes a DebugType to the audit log. The optional fields
+// are taken from the command being worked on when the event happened.
+func LogDebugEvent(cmd commands.Command, message string) {
+	usernameField, stockField, fileField, fundsField := commandFields(cmd)
+
+	xmlElement := fmt.Sprintf(`
+	<debugEvent>
+		<timestamp>%d</timestamp>
+		<server>%s</server>
+		<transactionNum>%d</transactionNum>
+		<command>%s</command>%s%s%s%s%s
+	</debugEvent>`,
+		nowInMillisec(), servername, cmd.ID, cmd.Name,
+		usernameField, stockField, fileField, fundsField,
+		formatDebugMessage(message),
+	)
+
+	writeEvent(cmd.UserID, xmlElement)
+}
+
+// commandFields : Formats the optional fields shared by all of the
+// command-like log elements. Empty strings are returned for fields
+// that the command doesn't have.
+func commandFields(cmd commands.Command) (usernameField, stockField, fileField, fundsField string) {
+	// Parse the optional fields. Initialized to "" which is the default case.
 	// With the exception of the admin DUMPLOG, all commands will have a
 	// userID. We'll assign it now and deal with the admin DUMPLOG reassignment
 	// in the switch. ID and command name won't have to be reassigned so we'll
@@ -118,33 +265,37 @@ func LogCommand(cmd commands.Command) {
 	case commands.DisplaySummary:
 		break
 	case commands.DumpLog:
-		// Only way to tell difference between user / admin command
-		// is to count the number of args
-		if len(cmd.Args) == 0 {
-			// It's an admin dump
-			// FIXME: ParseCommand interpreted the filename as the user
-			fileField = formatFile(cmd.UserID)
+		// The filename is always the only arg. Admin dumps are
+		// the ones without a user.
+		fileField = formatFile(cmd.Args[0])
+		if cmd.UserID == "" {
 			usernameField = ""
-		} else {
-			// It's a user dump
-			fileField = formatFile(cmd.Args[0])
 		}
 	}
 
-	timeInMillisec := time.Now().UnixNano() / 1000000
+	return
+}
 
+// LogAccountTransaction : Writes an AccountTransactionType to the audit log.
+// action should be one of AddAction or RemoveAction.
+func LogAccountTransaction(action, userID string, funds currency.Currency, transactionNum int) {
 	xmlElement := fmt.Sprintf(`
-	<userCommand>
+	<accountTransaction>
 		<timestamp>%d</timestamp>
 		<server>%s</server>
 		<transactionNum>%d</transactionNum>
-		<command>%s</command>%s%s%s%s
-	</userCommand>`,
-		timeInMillisec, servername, cmd.ID, cmd.Name,
-		usernameField, stockField, fileField, fundsField,
+		<action>%s</action>
+		<username>%s</username>
+		<funds>%.2f</funds>
+	</accountTransaction>`,
+		nowInMillisec(), servername, transactionNum, action, userID, funds.ToFloat(),
 	)
 
-	auditlogFile.WriteString(xmlElement)
+	writeEvent(userID, xmlElement)
+}
+
+func nowInMillisec() int64 {
+	return time.Now().UnixNano() / 1000000
 }
 
 func formatUsername(name string) string {
@@ -163,9 +314,24 @@ func formatFunds(funds string) string {
 	return fmt.Sprintf("\n\t\t<funds>%s</funds>", funds)
 }
 
+func formatErrorMessage(message string) string {
+	return fmt.Sprintf("\n\t\t<errorMessage>%s</errorMessage>", escapeText(message))
+}
+
+func formatDebugMessage(message string) string {
+	return fmt.Sprintf("\n\t\t<debugMessage>%s</debugMessage>", escapeText(message))
+}
+
+// escapeText : Messages can contain anything so escape them before they go in the XML
+func escapeText(s string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
 // LogQuoteServerHit : Writes a QuoteServerType to the log
-func LogQuoteServerHit(s string) {
+func LogQuoteServerHit(userID, s string) {
 	// FIXME : s needs to be pre-formatted by the caller.
 	// 		Pretty bad isolation IMO. (or is it separation of concerns?)
-	auditlogFile.WriteString(s)
+	writeEvent(userID, s)
 }
@@ -0,0 +1,254 @@
+package auditlogger
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/distributeddesigns/milestone1/commands"
+)
+
+// span : Where an event was written in the audit file
+type span struct {
+	offset int64
+	length int64
+}
+
+var (
+	// The events written to the audit file so far lie between eventsStart
+	// and eventsEnd. Only their offsets are kept; DUMPLOG reads the events
+	// back from the audit file so the history doesn't grow with the log.
+	eventsStart int64
+	eventsEnd   int64
+
+	// Where each user's events are in the audit file, oldest first
+	userEvents = make(map[string][]span)
+
+	// Where each user's userCommands are in the audit file, oldest first.
+	// Used for DISPLAY_SUMMARY.
+	userCommands = make(map[string][]span)
+
+	// Guards auditlogFile, eventsEnd, userEvents and userCommands
+	auditlogMutex sync.Mutex
+)
+
+// errNotAuditLog : Resume was given a file that isn't one of ours
+var errNotAuditLog = errors.New("Not an audit log")
+
+// loggedEvent : The fields of a logged element needed to index it and to
+// read a userCommand back as a command
+type loggedEvent struct {
+	XMLName        xml.Name
+	TransactionNum int    `xml:"transactionNum"`
+	Command        string `xml:"command"`
+	Username       string `xml:"username"`
+	StockSymbol    string `xml:"stockSymbol"`
+	Filename       string `xml:"filename"`
+	Funds          string `xml:"funds"`
+}
+
+// command : The userCommand as it was issued. Undoes commandFields, so
+// only the arguments the log has a field for come back.
+func (ev loggedEvent) command() (commands.Command, error) {
+	name, err := commands.ToCommandType(ev.Command)
+	if err != nil {
+		return commands.Command{}, err
+	}
+
+	cmd := commands.Command{ID: ev.TransactionNum, Name: name, UserID: ev.Username, Args: []string{}}
+	for _, arg := range []string{ev.StockSymbol, ev.Filename, ev.Funds} {
+		if arg != "" {
+			cmd.Args = append(cmd.Args, arg)
+		}
+	}
+	return cmd, nil
+}
+
+// resetIndex : Forget every event. The next one is written at offset.
+func resetIndex(offset int64) {
+	auditlogMutex.Lock()
+	defer auditlogMutex.Unlock()
+
+	eventsStart, eventsEnd = offset, offset
+	userEvents = make(map[string][]span)
+	userCommands = make(map[string][]span)
+}
+
+// writeEvent : Appends a formatted element to the audit file and records
+// where it went.
+func writeEvent(username, xmlElement string) {
+	auditlogMutex.Lock()
+	defer auditlogMutex.Unlock()
+
+	indexEvent(username, false, span{eventsEnd, writeString(xmlElement)})
+}
+
+// writeCommand : Like writeEvent, for a userCommand
+func writeCommand(username, xmlElement string) {
+	auditlogMutex.Lock()
+	defer auditlogMutex.Unlock()
+
+	indexEvent(username, true, span{eventsEnd, writeString(xmlElement)})
+}
+
+func writeString(xmlElement string) int64 {
+	n, _ := auditlogFile.WriteString(xmlElement)
+	return int64(n)
+}
+
+// indexEvent : Records where an event went. It must be the last one in
+// the file. auditlogMutex must be held.
+func indexEvent(username string, isCommand bool, ev span) {
+	if username != "" {
+		userEvents[username] = append(userEvents[username], ev)
+		if isCommand {
+			userCommands[username] = append(userCommands[username], ev)
+		}
+	}
+	eventsEnd = ev.offset + ev.length
+}
+
+// indexEvents : Indexes the events already in an audit file and gets it
+// ready for more. A new file gets the header. Anything after the last
+// whole event, like the footer or an event cut short by a crash, is cut off.
+func indexEvents(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		n, err := file.WriteString(logHeader)
+		if err != nil {
+			return err
+		}
+		resetIndex(int64(n))
+		return nil
+	}
+
+	header := make([]byte, len(logHeader))
+	if _, err := io.ReadFull(file, header); err != nil || string(header) != logHeader {
+		return errNotAuditLog
+	}
+	resetIndex(int64(len(logHeader)))
+
+	auditlogMutex.Lock()
+	defer auditlogMutex.Unlock()
+
+	// The events are a sequence of elements following the header. The
+	// footer's </log> has no start in there, so decoding stops at it.
+	d := xml.NewDecoder(io.NewSectionReader(file, eventsStart, info.Size()-eventsStart))
+	for {
+		token, err := d.Token()
+		if err != nil {
+			break
+		}
+		start, isStart := token.(xml.StartElement)
+		if !isStart {
+			continue
+		}
+
+		var ev loggedEvent
+		if err := d.DecodeElement(&ev, &start); err != nil {
+			break
+		}
+		// Each event's span runs from the end of the one before it
+		end := eventsStart + d.InputOffset()
+		indexEvent(ev.Username, ev.XMLName.Local == "userCommand", span{eventsEnd, end - eventsEnd})
+	}
+
+	if err := file.Truncate(eventsEnd); err != nil {
+		return err
+	}
+	_, err = file.Seek(eventsEnd, io.SeekStart)
+	return err
+}
+
+// UserCommands : Every command userID has issued so far, oldest first.
+// They're read back from the audit file.
+func UserCommands(userID string) ([]commands.Command, error) {
+	auditlogMutex.Lock()
+	spans := make([]span, len(userCommands[userID]))
+	copy(spans, userCommands[userID])
+	auditlogMutex.Unlock()
+
+	auditFile, err := os.Open(auditlogFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer auditFile.Close()
+
+	history := make([]commands.Command, 0, len(spans))
+	for _, s := range spans {
+		element, err := ioutil.ReadAll(io.NewSectionReader(auditFile, s.offset, s.length))
+		if err != nil {
+			return nil, err
+		}
+		var ev loggedEvent
+		if err := xml.Unmarshal(element, &ev); err != nil {
+			return nil, err
+		}
+		cmd, err := ev.command()
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, cmd)
+	}
+
+	return history, nil
+}
+
+// DumpLog : Writes every event logged so far to filename as a complete log.
+func DumpLog(filename string) error {
+	auditlogMutex.Lock()
+	events := []span{{eventsStart, eventsEnd - eventsStart}}
+	auditlogMutex.Unlock()
+
+	return dumpSpans(filename, events)
+}
+
+// DumpUserLog : Writes every event logged so far for userID to filename
+// as a complete log.
+func DumpUserLog(userID, filename string) error {
+	auditlogMutex.Lock()
+	events := make([]span, len(userEvents[userID]))
+	copy(events, userEvents[userID])
+	auditlogMutex.Unlock()
+
+	return dumpSpans(filename, events)
+}
+
+// dumpSpans : Copies the events out of the audit file into a new log.
+// What's already been written never changes, so the lock isn't held
+// during file IO.
+func dumpSpans(filename string, events []span) error {
+	auditFile, err := os.Open(auditlogFile.Name())
+	if err != nil {
+		return err
+	}
+	defer auditFile.Close()
+
+	dumpFile, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer dumpFile.Close()
+
+	if _, err := dumpFile.WriteString(logHeader); err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if _, err := io.Copy(dumpFile, io.NewSectionReader(auditFile, ev.offset, ev.length)); err != nil {
+			return err
+		}
+	}
+	if _, err := dumpFile.WriteString(logFooter); err != nil {
+		return err
+	}
+
+	consoleLog.Infof("Dumped the audit log to %s", filename)
+
+	return nil
+}
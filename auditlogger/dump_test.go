@@ -0,0 +1,111 @@
+package auditlogger
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+)
+
+// countEvents : Checks filename is a whole log and counts the events in it
+func countEvents(t *testing.T, filename string) int {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log struct {
+		Events []loggedEvent `xml:",any"`
+	}
+	if err := xml.Unmarshal(contents, &log); err != nil {
+		t.Fatalf("%s isn't a whole log: %s\n%s", filename, err.Error(), contents)
+	}
+	return len(log.Events)
+}
+
+func checkCommands(t *testing.T, when, userID string, want []commands.Command) {
+	got, err := UserCommands(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: %s issued %+v, want %+v", when, userID, got, want)
+	}
+}
+
+func TestResumeCarriesOnFromEarlierRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditFile := filepath.Join(dir, "data", "audit.xml")
+
+	add := commands.Command{ID: 1, Name: commands.Add, UserID: "alice", Args: []string{"100.00"}}
+	quote := commands.Command{ID: 2, Name: commands.Quote, UserID: "bob", Args: []string{"ABC"}}
+	buy := commands.Command{ID: 3, Name: commands.Buy, UserID: "alice", Args: []string{"ABC", "10.00"}}
+	commit := commands.Command{ID: 4, Name: commands.CommitBuy, UserID: "alice", Args: []string{}}
+	dump := commands.Command{ID: 5, Name: commands.DumpLog, Args: []string{"everything.xml"}}
+
+	// First run
+	closeAuditFile, err := Resume(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LogCommand(add)
+	LogAccountTransaction(AddAction, "alice", testutil.Money(t, "100.00"), 1)
+	LogCommand(quote)
+	LogCommand(buy)
+	checkCommands(t, "first run", "alice", []commands.Command{add, buy})
+	closeAuditFile()
+
+	// A crash while writing an event leaves part of it behind
+	f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n\t<userCommand>\n\t\t<timestamp>")
+	f.Close()
+
+	// Second run
+	closeAuditFile, err = Resume(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LogCommand(commit)
+	LogCommand(dump)
+
+	checkCommands(t, "second run", "alice", []commands.Command{add, buy, commit})
+	checkCommands(t, "second run", "bob", []commands.Command{quote})
+
+	userLog := filepath.Join(dir, "alice.xml")
+	if err := DumpUserLog("alice", userLog); err != nil {
+		t.Fatal(err)
+	}
+	if n := countEvents(t, userLog); n != 4 {
+		t.Errorf("alice's dump has %d events, want 4", n)
+	}
+
+	closeAuditFile()
+	if n := countEvents(t, auditFile); n != 6 {
+		t.Errorf("audit file has %d events, want 6", n)
+	}
+}
+
+func TestResumeRefusesOtherFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "auditlogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("accounts go here\n")
+	f.Close()
+
+	if _, err := Resume(f.Name()); err != errNotAuditLog {
+		t.Errorf("Resume returned %v, want %v", err, errNotAuditLog)
+	}
+}
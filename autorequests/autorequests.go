@@ -2,10 +2,14 @@ package autorequests
 
 import (
 	"errors"
+	"sort"
+	"sync"
 
 	"github.com/distributeddesigns/currency"
 
 	"github.com/op/go-logging"
+
+	"github.com/distributeddesigns/milestone1/accounts"
 )
 
 var (
@@ -14,68 +18,309 @@ var (
 
 // AutoRequest :  A buy or sell request for a user
 type AutoRequest struct {
+	// The transaction that created it. Tells a user's requests for a
+	// stock apart; the newest has the highest ID.
+	ID      int
+	State   State
 	Amount  currency.Currency
 	Trigger currency.Currency
+	// Funds held in the user's account for a buy. NoReservation for sells.
+	ReservationID accounts.ReservationID
+	// Shares taken from the user's portfolio by an armed sell
+	Units accounts.Shares
 }
 
-// AutoRequestStore : Map stock -> user -> request
-type AutoRequestStore map[string]map[string]AutoRequest
+// AutoRequestStore : Map stock -> user -> requests, oldest first. Safe for
+// concurrent use.
+type AutoRequestStore struct {
+	requests map[string]map[string][]AutoRequest
+	mutex    sync.RWMutex
+}
 
 // NewAutoRequestStore :
 func NewAutoRequestStore() *AutoRequestStore {
-	ars := make(AutoRequestStore)
-
-	return &ars
+	return &AutoRequestStore{
+		requests: make(map[string]map[string][]AutoRequest),
+	}
 }
 
-// AddAutorequest :
-func (ars *AutoRequestStore) AddAutorequest(stock, userID string, amount currency.Currency) {
-	// Initialize the new user -> request map if don't find
+// AddAutorequest : Adds a new request for the user. id must be newer than
+// any of the user's other requests for the stock.
+func (ars *AutoRequestStore) AddAutorequest(stock, userID string, id int, amount currency.Currency, reservationID accounts.ReservationID) (Transition, error) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	// Initialize the new user -> requests map if don't find
 	// any entries for the stock in the store
-	if _, found := (*ars)[stock]; !found {
-		(*ars)[stock] = make(map[string]AutoRequest)
+	if _, found := ars.requests[stock]; !found {
+		ars.requests[stock] = make(map[string][]AutoRequest)
+	}
+
+	requests := ars.requests[stock][userID]
+	if len(requests) > 0 && requests[len(requests)-1].ID >= id {
+		return Transition{}, errors.New("Auto request IDs must increase")
+	}
+
+	request := AutoRequest{
+		ID:            id,
+		State:         AmountSet,
+		Amount:        amount,
+		ReservationID: reservationID,
+	}
+	ars.requests[stock][userID] = append(requests, request)
+
+	return Transition{stock, userID, request, AmountSet, AmountSet, true}, nil
+}
+
+// SetAmount : Changes the amount of one of the user's requests. It stays
+// in the state it's in.
+func (ars *AutoRequestStore) SetAmount(stock, userID string, id int, amount currency.Currency, reservationID accounts.ReservationID) (Transition, error) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	i, found := ars.find(stock, userID, id)
+	if !found {
+		return Transition{}, errNoAutoRequest
 	}
 
-	// Initialize a new AutoRequest if we can't find a user.
-	// This is only necessary because there's no `nil` for AutoRequest.
-	if _, found := (*ars)[stock][userID]; !found {
-		(*ars)[stock][userID] = AutoRequest{}
+	request := &ars.requests[stock][userID][i]
+	if !canMove(request.State, request.State) {
+		return Transition{}, illegalMove(request.State, request.State)
 	}
 
-	// This awkward re-assignment is here because Go doesn't let you
-	// reference struct fields of indirect objects.
-	// See https://github.com/golang/go/issues/3117
-	request := (*ars)[stock][userID]
 	request.Amount = amount
-	(*ars)[stock][userID] = request
+	request.ReservationID = reservationID
+
+	return Transition{stock, userID, *request, request.State, request.State, false}, nil
+}
+
+// SetTrigger : Arms the user's request to fire at trigger. Setting the
+// trigger of an armed request moves it.
+func (ars *AutoRequestStore) SetTrigger(stock, userID string, id int, trigger currency.Currency) (Transition, error) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	i, found := ars.find(stock, userID, id)
+	if !found {
+		return Transition{}, errNoAutoRequest
+	}
+
+	request := &ars.requests[stock][userID][i]
+	if !canMove(request.State, Armed) {
+		return Transition{}, illegalMove(request.State, Armed)
+	}
+
+	from := request.State
+	request.Trigger = trigger
+	request.State = Armed
+
+	return Transition{stock, userID, *request, from, Armed, false}, nil
+}
+
+// HoldShares : Records the shares an armed sell took from the user
+func (ars *AutoRequestStore) HoldShares(stock, userID string, id int, units accounts.Shares) error {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	i, found := ars.find(stock, userID, id)
+	if !found {
+		return errNoAutoRequest
+	}
+
+	request := &ars.requests[stock][userID][i]
+	if request.State != Armed {
+		return errors.New("Only an armed auto request can hold shares")
+	}
+
+	request.Units = units
+	return nil
+}
+
+// CancelAutorequest : Retires the user's request as Cancelled. The
+// Transition's Request has what it was holding.
+func (ars *AutoRequestStore) CancelAutorequest(stock, userID string, id int) (Transition, error) {
+	return ars.retire(stock, userID, id, Cancelled)
+}
+
+// FillAutorequest : Retires the user's armed request as Filled
+func (ars *AutoRequestStore) FillAutorequest(stock, userID string, id int) (Transition, error) {
+	return ars.retire(stock, userID, id, Filled)
+}
+
+// ExpireAutorequest : Retires a request that can never be filled as Expired
+func (ars *AutoRequestStore) ExpireAutorequest(stock, userID string, id int) (Transition, error) {
+	return ars.retire(stock, userID, id, Expired)
+}
+
+// retire : Moves the user's request to a final state and drops it
+func (ars *AutoRequestStore) retire(stock, userID string, id int, to State) (Transition, error) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	i, found := ars.find(stock, userID, id)
+	if !found {
+		errMsg := "No request found for stock " + stock + " for user " + userID
+		return Transition{}, errors.New(errMsg)
+	}
+
+	requests := ars.requests[stock][userID]
+	request := requests[i]
+	if !canMove(request.State, to) {
+		return Transition{}, illegalMove(request.State, to)
+	}
+
+	remaining := append(requests[:i:i], requests[i+1:]...)
+	if len(remaining) > 0 {
+		ars.requests[stock][userID] = remaining
+	} else {
+		delete(ars.requests[stock], userID)
+	}
+	if len(ars.requests[stock]) == 0 {
+		delete(ars.requests, stock)
+	}
+
+	from := request.State
+	request.State = to
+	return Transition{stock, userID, request, from, to, false}, nil
 }
 
-// CancelAutorequest :
-func (ars *AutoRequestStore) CancelAutorequest(stock, userID string) (currency.Currency, error) {
-	if _, found := (*ars)[stock][userID]; found {
-		delete((*ars)[stock], userID)
-		refundAmount := (*ars)[stock][userID].Amount.ToFloat()
-		theCurrency, err := currency.NewFromFloat(refundAmount)
-		if err != nil {
-			consoleLog.Error("Unable to create currency")
+// find : Where the request is in the user's requests for the stock.
+// The caller must hold the lock.
+func (ars *AutoRequestStore) find(stock, userID string, id int) (int, bool) {
+	for i, request := range ars.requests[stock][userID] {
+		if request.ID == id {
+			return i, true
 		}
-		return theCurrency, nil
 	}
-	errMsg := "No request found for stock " + stock + " for user " + userID
-	return currency.Currency{}, errors.New(errMsg)
+	return 0, false
 }
 
-// AutorequestExists :
+// AutorequestExists : True if the user has any requests for the stock
 func (ars *AutoRequestStore) AutorequestExists(stock, userID string) bool {
-	_, found := (*ars)[stock][userID]
-	return found
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	return len(ars.requests[stock][userID]) > 0
+}
+
+// GetStockAutorequests : A copy of every user's requests for a stock, keyed by user
+func (ars *AutoRequestStore) GetStockAutorequests(stock string) map[string][]AutoRequest {
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	stockRequests := make(map[string][]AutoRequest)
+	for userID, requests := range ars.requests[stock] {
+		stockRequests[userID] = copyRequests(requests)
+	}
+	return stockRequests
+}
+
+// GetUserAutorequests : All of a user's requests, keyed by stock
+func (ars *AutoRequestStore) GetUserAutorequests(userID string) map[string][]AutoRequest {
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	userRequests := make(map[string][]AutoRequest)
+	for stock, requests := range ars.requests {
+		if userStockRequests, found := requests[userID]; found {
+			userRequests[stock] = copyRequests(userStockRequests)
+		}
+	}
+	return userRequests
 }
 
-// GetAutorequest :
-func (ars *AutoRequestStore) GetAutorequest(stock, userID string) (AutoRequest, error) {
-	userAutoRequest, found := (*ars)[stock][userID]
-	if found {
-		return userAutoRequest, nil
+// Users : Everyone with a request, sorted
+func (ars *AutoRequestStore) Users() []string {
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	users := []string{}
+	for _, requests := range ars.requests {
+		for userID := range requests {
+			if !seen[userID] {
+				seen[userID] = true
+				users = append(users, userID)
+			}
+		}
 	}
-	return AutoRequest{}, errors.New("No auto request")
+	sort.Strings(users)
+	return users
+}
+
+// ArmedStocks : Every stock with at least one armed request, sorted
+func (ars *AutoRequestStore) ArmedStocks() []string {
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	stocks := []string{}
+	for stock, requests := range ars.requests {
+		if hasArmed(requests) {
+			stocks = append(stocks, stock)
+		}
+	}
+	sort.Strings(stocks)
+	return stocks
+}
+
+func hasArmed(requests map[string][]AutoRequest) bool {
+	for _, userRequests := range requests {
+		for _, request := range userRequests {
+			if request.State == Armed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetUserAutorequests : Replaces all of a user's requests. requests is
+// keyed by stock, oldest first.
+func (ars *AutoRequestStore) SetUserAutorequests(userID string, requests map[string][]AutoRequest) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	for stock, stockRequests := range ars.requests {
+		delete(stockRequests, userID)
+		if len(stockRequests) == 0 {
+			delete(ars.requests, stock)
+		}
+	}
+
+	for stock, userStockRequests := range requests {
+		if len(userStockRequests) == 0 {
+			continue
+		}
+		if _, found := ars.requests[stock]; !found {
+			ars.requests[stock] = make(map[string][]AutoRequest)
+		}
+		ars.requests[stock][userID] = copyRequests(userStockRequests)
+	}
+}
+
+// GetAutorequest : One of the user's requests for the stock
+func (ars *AutoRequestStore) GetAutorequest(stock, userID string, id int) (AutoRequest, error) {
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	if i, found := ars.find(stock, userID, id); found {
+		return ars.requests[stock][userID][i], nil
+	}
+	return AutoRequest{}, errNoAutoRequest
+}
+
+// LatestAutorequest : The user's newest request for the stock
+func (ars *AutoRequestStore) LatestAutorequest(stock, userID string) (AutoRequest, error) {
+	ars.mutex.RLock()
+	defer ars.mutex.RUnlock()
+
+	requests := ars.requests[stock][userID]
+	if len(requests) == 0 {
+		return AutoRequest{}, errNoAutoRequest
+	}
+	return requests[len(requests)-1], nil
+}
+
+func copyRequests(requests []AutoRequest) []AutoRequest {
+	return append([]AutoRequest(nil), requests...)
 }
@@ -0,0 +1,198 @@
+package autorequests
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/quotecache"
+)
+
+// Fill : An armed request that a price update set off. Each fill is its
+// own transaction, numbered apart from the workload's commands.
+type Fill struct {
+	TransactionNum int
+	// Buy or Sell
+	Command commands.CommandType
+	Stock   string
+	UserID  string
+	Request AutoRequest
+	Quote   quotecache.Quote
+}
+
+// FillFunc : Carries out a fill against its owner's account
+type FillFunc func(Fill) error
+
+// Engine : Checks every user's requests for a stock whenever its price
+// changes and hands the ones that fire to FillBuy or FillSell.
+//
+// Price updates can arrive from any goroutine. They're held until
+// RunPending so fills never run alongside a command. Only the newest
+// price for each stock is kept.
+type Engine struct {
+	autoBuys  *AutoRequestStore
+	autoSells *AutoRequestStore
+	fillBuy   FillFunc
+	fillSell  FillFunc
+
+	nextTransaction int
+	pending         map[string]quotecache.Quote
+	// Guards nextTransaction and pending
+	mutex sync.Mutex
+}
+
+// NewEngine : A constructor for an engine over the buy and sell stores.
+// Fills are numbered from firstTransaction up.
+func NewEngine(
+	autoBuys, autoSells *AutoRequestStore,
+	fillBuy, fillSell FillFunc,
+	firstTransaction int,
+) *Engine {
+	return &Engine{
+		autoBuys:        autoBuys,
+		autoSells:       autoSells,
+		fillBuy:         fillBuy,
+		fillSell:        fillSell,
+		nextTransaction: firstTransaction,
+		pending:         make(map[string]quotecache.Quote),
+	}
+}
+
+// Subscribe : Starts listening for quotes fetched by the cache
+func (e *Engine) Subscribe(c *quotecache.Cache) {
+	c.Subscribe(e.PriceUpdated)
+}
+
+// PriceUpdated : Queues a quote to be checked against the requests on
+// the next RunPending
+func (e *Engine) PriceUpdated(q quotecache.Quote) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if queued, found := e.pending[q.Stock]; found && queued.Timestamp.After(q.Timestamp) {
+		return
+	}
+	e.pending[q.Stock] = q
+}
+
+// RunPending : Checks the queued price updates, in stock order. Returns
+// the fills that went through, so their owners' changed accounts and
+// requests can be saved.
+func (e *Engine) RunPending() []Fill {
+	e.mutex.Lock()
+	updates := e.pending
+	e.pending = make(map[string]quotecache.Quote)
+	e.mutex.Unlock()
+
+	stocks := []string{}
+	for stock := range updates {
+		stocks = append(stocks, stock)
+	}
+	sort.Strings(stocks)
+
+	var filled []Fill
+	for _, stock := range stocks {
+		filled = append(filled, e.Evaluate(updates[stock])...)
+	}
+	return filled
+}
+
+// Evaluate : Fills every armed request for the quote's stock that its
+// price sets off, buys first, then in user and request order. Returns
+// the fills that went through.
+func (e *Engine) Evaluate(q quotecache.Quote) []Fill {
+	var filled []Fill
+
+	buys := e.autoBuys.GetStockAutorequests(q.Stock)
+	for _, userID := range sortedUsers(buys) {
+		for _, request := range buys[userID] {
+			if request.State != Armed || !buyFires(request, q) {
+				continue
+			}
+			if fill, ok := e.fill(e.fillBuy, commands.Buy, q, userID, request); ok {
+				filled = append(filled, fill)
+			}
+		}
+	}
+
+	sells := e.autoSells.GetStockAutorequests(q.Stock)
+	for _, userID := range sortedUsers(sells) {
+		for _, request := range sells[userID] {
+			if request.State != Armed || !sellFires(request, q) {
+				continue
+			}
+			if fill, ok := e.fill(e.fillSell, commands.Sell, q, userID, request); ok {
+				filled = append(filled, fill)
+			}
+		}
+	}
+
+	return filled
+}
+
+// fill : Carries out a request that fired. False if the fill failed, which
+// leaves everything as it was.
+func (e *Engine) fill(fn FillFunc, side commands.CommandType, q quotecache.Quote, userID string, request AutoRequest) (Fill, bool) {
+	fill := Fill{
+		TransactionNum: e.TakeTransaction(),
+		Command:        side,
+		Stock:          q.Stock,
+		UserID:         userID,
+		Request:        request,
+		Quote:          q,
+	}
+
+	consoleLog.Infof("Automated %s #%d of %s for %s fired at %s", side, request.ID, q.Stock, userID, q.Price)
+	if err := fn(fill); err != nil {
+		consoleLog.Infof("Automated %s #%d of %s for %s not filled: %s", side, request.ID, q.Stock, userID, err.Error())
+		return Fill{}, false
+	}
+	return fill, true
+}
+
+// TakeTransaction : The next transaction number set aside for fills and
+// anything else the engine does on its own
+func (e *Engine) TakeTransaction() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	transactionNum := e.nextTransaction
+	e.nextTransaction++
+	return transactionNum
+}
+
+// NextTransaction : The number TakeTransaction will return next. Saved
+// so numbers aren't handed out twice across a restart.
+func (e *Engine) NextTransaction() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.nextTransaction
+}
+
+// SetNextTransaction : Carries on numbering from a saved NextTransaction
+func (e *Engine) SetNextTransaction(transactionNum int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.nextTransaction = transactionNum
+}
+
+// buyFires : A buy fires once the price falls to its trigger
+func buyFires(ar AutoRequest, q quotecache.Quote) bool {
+	return q.Price.ToFloat() <= ar.Trigger.ToFloat()
+}
+
+// sellFires : A sell fires once the price rises to its trigger
+func sellFires(ar AutoRequest, q quotecache.Quote) bool {
+	return q.Price.ToFloat() >= ar.Trigger.ToFloat()
+}
+
+func sortedUsers(requests map[string][]AutoRequest) []string {
+	userIDs := []string{}
+	for userID := range requests {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
@@ -0,0 +1,85 @@
+package autorequests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/quotecache"
+)
+
+// newTestEngine : alice has an automated buy of ABC armed at $10.00 and
+// an automated sell armed at $20.00. Fills are collected, not carried out.
+func newTestEngine(t *testing.T) (engine *Engine, buys, sells *[]Fill) {
+	autoBuys, autoSells := NewAutoRequestStore(), NewAutoRequestStore()
+	for _, armed := range []struct {
+		store   *AutoRequestStore
+		trigger string
+	}{{autoBuys, "10.00"}, {autoSells, "20.00"}} {
+		if _, err := armed.store.AddAutorequest("ABC", "alice", 1, testutil.Money(t, "100.00"), accounts.NoReservation); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := armed.store.SetTrigger("ABC", "alice", 1, testutil.Money(t, armed.trigger)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buys, sells = &[]Fill{}, &[]Fill{}
+	collect := func(fills *[]Fill) FillFunc {
+		return func(f Fill) error {
+			*fills = append(*fills, f)
+			return nil
+		}
+	}
+	return NewEngine(autoBuys, autoSells, collect(buys), collect(sells), 1000), buys, sells
+}
+
+func TestTriggersFireWhenThePriceCrossesThem(t *testing.T) {
+	tests := []struct {
+		price     string
+		buy, sell bool
+	}{
+		{price: "5.00", buy: true},
+		{price: "10.00", buy: true},
+		{price: "10.01"},
+		{price: "15.00"},
+		{price: "19.99"},
+		{price: "20.00", sell: true},
+		{price: "68.63", sell: true},
+	}
+
+	for _, test := range tests {
+		engine, buys, sells := newTestEngine(t)
+		engine.Evaluate(quotecache.Quote{Stock: "ABC", Price: testutil.Money(t, test.price), Timestamp: time.Now()})
+
+		bought, sold := len(*buys) > 0, len(*sells) > 0
+		if bought != test.buy {
+			t.Errorf("at %s the $10.00 buy fired: %t, want %t", test.price, bought, test.buy)
+		}
+		if sold != test.sell {
+			t.Errorf("at %s the $20.00 sell fired: %t, want %t", test.price, sold, test.sell)
+		}
+	}
+}
+
+func TestFillsCarryOnFromTheSavedNumber(t *testing.T) {
+	engine, fills, _ := newTestEngine(t)
+	if n := engine.NextTransaction(); n != 1000 {
+		t.Fatalf("new engine starts at %d, want 1000", n)
+	}
+
+	// As if resumed after fills up to 1041 were saved
+	engine.SetNextTransaction(1042)
+	engine.PriceUpdated(quotecache.Quote{Stock: "ABC", Price: testutil.Money(t, "9.00"), Timestamp: time.Now()})
+	if filled := engine.RunPending(); len(filled) != 1 {
+		t.Fatalf("%d requests filled, want 1", len(filled))
+	}
+
+	if (*fills)[0].TransactionNum != 1042 {
+		t.Errorf("fill took transaction %d, want 1042", (*fills)[0].TransactionNum)
+	}
+	if n := engine.NextTransaction(); n != 1043 {
+		t.Errorf("next transaction is %d, want 1043", n)
+	}
+}
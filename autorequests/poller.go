@@ -0,0 +1,236 @@
+package autorequests
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distributeddesigns/milestone1/quotecache"
+)
+
+// PollerOptions : How often the Poller refreshes quotes
+type PollerOptions struct {
+	// How long a stock's quote can go without a refresh
+	Interval time.Duration
+	// Used instead of Interval while the price is within Near of a trigger
+	FastInterval time.Duration
+	// How close, as a fraction of the price, counts as near a trigger
+	Near float64
+	// Most quote server requests to make per second. 0 is no limit.
+	RateLimit float64
+	// Fills the triggers a refreshed quote set off. It's called on the
+	// polling goroutine, so it has to keep the fills from running
+	// alongside anything else that changes accounts. Defaults to the
+	// engine's RunPending.
+	RunFills func()
+}
+
+// Poller : Keeps the quotes for every stock with an armed request fresh
+// so triggers fire without anyone asking for a quote. Each stock is
+// fetched once for everyone with a request on it, so the quotes reach the
+// engine through the cache's subscribers like any other, and the fills
+// they set off are run straight away.
+type Poller struct {
+	cache  *quotecache.Cache
+	engine *Engine
+	opts   PollerOptions
+
+	// When each stock is next due and how often it's being polled. Only
+	// touched by the polling goroutine.
+	due       map[string]time.Time
+	intervals map[string]time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPoller : A constructor for a poller over the engine's requests. It
+// doesn't poll until Start.
+func NewPoller(cache *quotecache.Cache, engine *Engine, opts PollerOptions) *Poller {
+	if opts.FastInterval <= 0 || opts.FastInterval > opts.Interval {
+		opts.FastInterval = opts.Interval
+	}
+	if opts.RunFills == nil {
+		opts.RunFills = func() { engine.RunPending() }
+	}
+
+	return &Poller{
+		cache:     cache,
+		engine:    engine,
+		opts:      opts,
+		due:       make(map[string]time.Time),
+		intervals: make(map[string]time.Duration),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start : Starts polling in the background
+func (p *Poller) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+// Stop : Stops polling and waits for the request in progress, if any
+func (p *Poller) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *Poller) run() {
+	defer p.wg.Done()
+
+	// Requests are spaced out to stay under the rate limit
+	var gap time.Duration
+	if p.opts.RateLimit > 0 {
+		gap = time.Duration(float64(time.Second) / p.opts.RateLimit)
+	}
+
+	for {
+		stock, wait := p.nextDue(time.Now())
+		if !p.sleep(wait) {
+			return
+		}
+		if stock == "" {
+			continue
+		}
+
+		p.poll(stock)
+		if !p.sleep(gap) {
+			return
+		}
+	}
+}
+
+// sleep : Waits for d. False if the poller was stopped meanwhile.
+func (p *Poller) sleep(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-p.stop:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-p.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// nextDue : The armed stock that's due soonest and how long until it's
+// due. New stocks are due straight away. With nothing due within
+// FastInterval, the stock is "" and the poller just looks again later,
+// which is how it notices new triggers.
+func (p *Poller) nextDue(now time.Time) (string, time.Duration) {
+	armed := make(map[string]bool)
+	for _, stock := range p.engine.autoBuys.ArmedStocks() {
+		armed[stock] = true
+	}
+	for _, stock := range p.engine.autoSells.ArmedStocks() {
+		armed[stock] = true
+	}
+
+	for stock := range p.due {
+		if !armed[stock] {
+			delete(p.due, stock)
+			delete(p.intervals, stock)
+		}
+	}
+
+	soonest, wait := "", p.opts.FastInterval
+	for stock := range armed {
+		due, found := p.due[stock]
+		if !found {
+			due = now
+			p.due[stock] = due
+			p.intervals[stock] = p.opts.Interval
+		}
+
+		untilDue := due.Sub(now)
+		if untilDue < wait || (untilDue == wait && stock < soonest) {
+			soonest, wait = stock, untilDue
+		}
+	}
+
+	return soonest, wait
+}
+
+// poll : Refreshes the stock's quote, fills what it sets off and decides
+// when to look again
+func (p *Poller) poll(stock string) {
+	owners, triggers := p.armedRequests(stock)
+	if len(owners) == 0 {
+		// Cancelled since nextDue looked
+		return
+	}
+
+	// A quote someone else fetched recently enough saves a request
+	maxAge := p.intervals[stock]
+	interval := p.opts.Interval
+
+	// The request is made on behalf of the first owner but serves them
+	// all. It's audited under the number the first fill it sets off will
+	// take, so polls that fill nothing don't use numbers up.
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.Interval)
+	defer cancel()
+	quote, err := p.cache.GetFreshQuote(ctx, owners[0], stock, p.engine.NextTransaction(), maxAge)
+	if err != nil {
+		consoleLog.Warningf("Couldn't refresh %s for its triggers: %s", stock, err.Error())
+	} else {
+		p.opts.RunFills()
+		if nearTrigger(quote.Price.ToFloat(), triggers, p.opts.Near) {
+			interval = p.opts.FastInterval
+		}
+	}
+
+	p.due[stock] = time.Now().Add(interval)
+	p.intervals[stock] = interval
+}
+
+// armedRequests : Who has an armed request on the stock, sorted, and
+// their trigger prices
+func (p *Poller) armedRequests(stock string) ([]string, []float64) {
+	seen := make(map[string]bool)
+	var triggers []float64
+
+	for _, requests := range []map[string][]AutoRequest{
+		p.engine.autoBuys.GetStockAutorequests(stock),
+		p.engine.autoSells.GetStockAutorequests(stock),
+	} {
+		for userID, userRequests := range requests {
+			for _, request := range userRequests {
+				if request.State == Armed {
+					seen[userID] = true
+					triggers = append(triggers, request.Trigger.ToFloat())
+				}
+			}
+		}
+	}
+
+	owners := []string{}
+	for userID := range seen {
+		owners = append(owners, userID)
+	}
+	sort.Strings(owners)
+
+	return owners, triggers
+}
+
+// nearTrigger : True if price is within near (a fraction of price) of
+// any of the triggers
+func nearTrigger(price float64, triggers []float64, near float64) bool {
+	for _, trigger := range triggers {
+		if math.Abs(price-trigger) <= price*near {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package autorequests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/quotecache"
+)
+
+func TestPolledQuotesFillWithoutACommand(t *testing.T) {
+	engine, buys, _ := newTestEngine(t)
+	source := quotecache.NewFakeQuoteSource(nil, 1)
+	source.SetPrice("ABC", testutil.Money(t, "15.00"))
+	cache := quotecache.NewCache(source)
+	engine.Subscribe(cache)
+
+	// Every poll's fills are handed over until the test is done with them
+	polls, done := make(chan []Fill), make(chan struct{})
+	poller := NewPoller(cache, engine, PollerOptions{
+		Interval: time.Millisecond,
+		RunFills: func() {
+			select {
+			case polls <- engine.RunPending():
+			case <-done:
+			}
+		},
+	})
+	poller.Start()
+	defer poller.Stop()
+	defer close(done)
+
+	// Between the triggers nothing fires, and no numbers are used up
+	for i := 0; i < 3; i++ {
+		if filled := <-polls; len(filled) != 0 {
+			t.Fatalf("poll at $15.00 filled %d requests, want 0", len(filled))
+		}
+	}
+	if n := engine.NextTransaction(); n != 1000 {
+		t.Errorf("polls that filled nothing moved the next fill to %d, want 1000", n)
+	}
+
+	source.SetPrice("ABC", testutil.Money(t, "9.00"))
+	var filled []Fill
+	for len(filled) == 0 {
+		filled = <-polls
+	}
+
+	if len(filled) != 1 || len(*buys) != 1 {
+		t.Fatalf("poll at $9.00 filled %d requests, want alice's buy", len(filled))
+	}
+	if filled[0].TransactionNum != 1000 {
+		t.Errorf("polled fill took transaction %d, want 1000", filled[0].TransactionNum)
+	}
+}
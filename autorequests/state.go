@@ -0,0 +1,85 @@
+package autorequests
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State : Where a request is in its life. Requests start out AmountSet,
+// are Armed once they have a trigger price and end Filled, Cancelled or
+// Expired. Requests that have ended are retired from the store, so they
+// can't be filled twice.
+type State int
+
+// State enum!
+const (
+	AmountSet State = iota
+	Armed
+	Filled
+	Cancelled
+	Expired
+)
+
+var stateNames = []string{
+	"amount set",
+	"armed",
+	"filled",
+	"cancelled",
+	"expired",
+}
+
+// String representation of the State enum
+func (s State) String() string {
+	return stateNames[s]
+}
+
+// MarshalText : Use the state name when State is encoded as text or JSON
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// IsFinal : True for the states a request ends in
+func (s State) IsFinal() bool {
+	return s == Filled || s == Cancelled || s == Expired
+}
+
+// canMove : True if a request in from can move to to. Re-arming an armed
+// request changes its trigger price. Staying put changes its amount.
+func canMove(from, to State) bool {
+	switch from {
+	case AmountSet:
+		return to == AmountSet || to == Armed || to == Cancelled || to == Expired
+	case Armed:
+		return to == Armed || to.IsFinal()
+	}
+	return false
+}
+
+var errNoAutoRequest = errors.New("No auto request")
+
+// Transition : A request moving from one state to another. Request is
+// the request after the move. Created requests start out AmountSet and
+// have no From.
+type Transition struct {
+	Stock   string
+	UserID  string
+	Request AutoRequest
+	From    State
+	To      State
+	Created bool
+}
+
+// String : e.g. "ABC #12 for bob: armed -> filled", or "new -> amount set"
+// when it's created
+func (t Transition) String() string {
+	from := t.From.String()
+	if t.Created {
+		from = "new"
+	}
+	return fmt.Sprintf("%s #%d for %s: %s -> %s", t.Stock, t.Request.ID, t.UserID, from, t.To)
+}
+
+// illegalMove : The error for a move canMove rejects
+func illegalMove(from, to State) error {
+	return fmt.Errorf("Can't move an auto request from %s to %s", from, to)
+}
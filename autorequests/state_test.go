@@ -0,0 +1,89 @@
+package autorequests
+
+import (
+	"testing"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+)
+
+func TestEveryLifecycleStepIsATransition(t *testing.T) {
+	store := NewAutoRequestStore()
+	amount := testutil.Money(t, "100.00")
+
+	tests := []struct {
+		step   string
+		move   func() (Transition, error)
+		amount string
+		want   string
+	}{
+		{"create", func() (Transition, error) {
+			return store.AddAutorequest("ABC", "alice", 1, amount, accounts.NoReservation)
+		}, "100.00", "ABC #1 for alice: new -> amount set"},
+		{"change the amount", func() (Transition, error) {
+			return store.SetAmount("ABC", "alice", 1, testutil.Money(t, "50.00"), accounts.NoReservation)
+		}, "50.00", "ABC #1 for alice: amount set -> amount set"},
+		{"arm", func() (Transition, error) {
+			return store.SetTrigger("ABC", "alice", 1, testutil.Money(t, "5.00"))
+		}, "50.00", "ABC #1 for alice: amount set -> armed"},
+		{"change an armed amount", func() (Transition, error) {
+			return store.SetAmount("ABC", "alice", 1, testutil.Money(t, "75.00"), accounts.NoReservation)
+		}, "75.00", "ABC #1 for alice: armed -> armed"},
+		{"move the trigger", func() (Transition, error) {
+			return store.SetTrigger("ABC", "alice", 1, testutil.Money(t, "6.00"))
+		}, "75.00", "ABC #1 for alice: armed -> armed"},
+		{"fill", func() (Transition, error) {
+			return store.FillAutorequest("ABC", "alice", 1)
+		}, "75.00", "ABC #1 for alice: armed -> filled"},
+		{"create another", func() (Transition, error) {
+			return store.AddAutorequest("ABC", "alice", 2, amount, accounts.NoReservation)
+		}, "100.00", "ABC #2 for alice: new -> amount set"},
+		{"cancel", func() (Transition, error) {
+			return store.CancelAutorequest("ABC", "alice", 2)
+		}, "100.00", "ABC #2 for alice: amount set -> cancelled"},
+		{"create a third", func() (Transition, error) {
+			return store.AddAutorequest("ABC", "alice", 3, amount, accounts.NoReservation)
+		}, "100.00", "ABC #3 for alice: new -> amount set"},
+		{"expire", func() (Transition, error) {
+			return store.ExpireAutorequest("ABC", "alice", 3)
+		}, "100.00", "ABC #3 for alice: amount set -> expired"},
+	}
+
+	for _, test := range tests {
+		transition, err := test.move()
+		if err != nil {
+			t.Fatalf("%s: %s", test.step, err.Error())
+		}
+		if got := transition.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.step, got, test.want)
+		}
+		if want := testutil.Money(t, test.amount); transition.Request.Amount != want {
+			t.Errorf("%s: request is for %s, want %s", test.step, transition.Request.Amount, want)
+		}
+		if transition.Request.State != transition.To {
+			t.Errorf("%s: request is %s after moving to %s", test.step, transition.Request.State, transition.To)
+		}
+	}
+}
+
+func TestRetiredRequestsCantMove(t *testing.T) {
+	store := NewAutoRequestStore()
+	if _, err := store.AddAutorequest("ABC", "alice", 1, testutil.Money(t, "100.00"), accounts.NoReservation); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only armed requests fill
+	if _, err := store.FillAutorequest("ABC", "alice", 1); err == nil {
+		t.Error("filled a request without a trigger")
+	}
+
+	if _, err := store.CancelAutorequest("ABC", "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetAmount("ABC", "alice", 1, testutil.Money(t, "5.00"), accounts.NoReservation); err != errNoAutoRequest {
+		t.Errorf("changing a cancelled request's amount returned %v, want %v", err, errNoAutoRequest)
+	}
+	if _, err := store.SetTrigger("ABC", "alice", 1, testutil.Money(t, "5.00")); err != errNoAutoRequest {
+		t.Errorf("arming a cancelled request returned %v, want %v", err, errNoAutoRequest)
+	}
+}
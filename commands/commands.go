@@ -60,6 +60,11 @@ func (c CommandType) String() string {
 	return commandNames[c]
 }
 
+// MarshalText : Use the command name when CommandType is encoded as text or JSON
+func (c CommandType) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
 // ToCommandType : Convert string -> CommandType enum
 func ToCommandType(cmd string) (CommandType, error) {
 	for i, name := range commandNames {
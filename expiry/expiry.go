@@ -0,0 +1,38 @@
+package expiry
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWindow : How long a quote is good for unless told otherwise
+const DefaultWindow = time.Second * 60
+
+// window holds a time.Duration. Read and written atomically since
+// every goroutine checking a quote or action reads it.
+var window = int64(DefaultWindow)
+
+// Window : How long a quote, and any Buy or Sell made at its price, can be used
+func Window() time.Duration {
+	return time.Duration(atomic.LoadInt64(&window))
+}
+
+// SetWindow : Changes the expiry window for everything created from now on
+// and everything already waiting.
+func SetWindow(d time.Duration) {
+	atomic.StoreInt64(&window, int64(d))
+}
+
+// TimeLeft : How long something created at t has left. Zero if it has expired.
+func TimeLeft(t time.Time) time.Duration {
+	left := t.Add(Window()).Sub(time.Now())
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// IsExpired : True if something created at t is older than the window
+func IsExpired(t time.Time) bool {
+	return TimeLeft(t) <= 0
+}
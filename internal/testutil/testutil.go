@@ -0,0 +1,17 @@
+// Package testutil : Helpers shared by the tests of other packages
+package testutil
+
+import (
+	"testing"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// Money : Parses an amount like "12.50", failing the test if it can't
+func Money(t testing.TB, s string) currency.Currency {
+	c, err := currency.NewFromString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,348 @@
+package invariants
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+)
+
+// Violation : Something that should never be true about the accounts.
+// TransactionNum and Command identify the transaction that introduced it.
+// They're zero if there's no transaction to blame, which only happens
+// when the ledger is empty. UserID is empty for the total cash.
+type Violation struct {
+	TransactionNum int
+	Command        commands.CommandType
+	UserID         string
+	Message        string
+}
+
+func (v Violation) String() string {
+	if v.UserID == "" {
+		return fmt.Sprintf("[%d] %s: %s", v.TransactionNum, v.Command, v.Message)
+	}
+	return fmt.Sprintf("[%d] %s %s: %s", v.TransactionNum, v.Command, v.UserID, v.Message)
+}
+
+// lastChange : The most recent transaction that changed a user's account
+type lastChange struct {
+	TransactionNum int
+	Command        commands.CommandType
+}
+
+// Checker : Verifies that accounts agree with the ledger and with each other.
+// The ledger is replayed incrementally so checking after every command
+// only costs the entries that command added.
+//
+// Invariants checked:
+//   - Balances never go negative and never fall below the reserved funds
+//   - Share removals never take more units than the user held
+//   - Balances and portfolios match what the ledger says they should be
+//   - Reserved funds equal the cost of pending buys plus the buy trigger amounts
+//   - Total cash equals all ADDs, plus other credits like sale proceeds,
+//     less debits like purchase costs
+//
+// The total cash is kept from each account's balance as it was last
+// checked, so it's checked after every command too.
+type Checker struct {
+	accounts  *accounts.AccountStore
+	autoBuys  *autorequests.AutoRequestStore
+	autoSells *autorequests.AutoRequestStore
+
+	// What the ledger says, up to ledgerChecked entries
+	ledgerChecked int
+	balances      map[string]currency.Currency
+	holdings      map[string]accounts.Portfolio
+	lastChanges   map[string]lastChange
+	latest        lastChange
+	added         currency.Currency
+	credited      currency.Currency
+	debited       currency.Currency
+
+	// Each account's balance when it was last checked, and their total
+	counted map[string]currency.Currency
+	total   currency.Currency
+
+	// Problems with each account found by the last check. They're only
+	// reported when first found, not again every time the user is checked.
+	open map[string]map[string]bool
+}
+
+// NewChecker : A constructor for a Checker over the stores
+func NewChecker(
+	as *accounts.AccountStore,
+	autoBuys, autoSells *autorequests.AutoRequestStore,
+) *Checker {
+	return &Checker{
+		accounts:    as,
+		autoBuys:    autoBuys,
+		autoSells:   autoSells,
+		balances:    make(map[string]currency.Currency),
+		holdings:    make(map[string]accounts.Portfolio),
+		lastChanges: make(map[string]lastChange),
+		counted:     make(map[string]currency.Currency),
+		open:        make(map[string]map[string]bool),
+	}
+}
+
+// CheckUsers : Checks the ledger entries added since the last check, the
+// accounts of userIDs and of anyone in those entries, and the total cash.
+// Problems with the accounts and the total are blamed on cmd.
+func (c *Checker) CheckUsers(cmd commands.Command, userIDs []string) []Violation {
+	blame := lastChange{cmd.ID, cmd.Name}
+
+	violations, changed := c.checkLedger()
+	for _, userID := range union(userIDs, changed) {
+		violations = append(violations, c.newProblems(userID, c.checkAccount(userID, blame))...)
+		c.count(userID)
+	}
+
+	return append(violations, c.checkTotal(blame)...)
+}
+
+// CheckAll : Checks the whole ledger, every account and the total cash in
+// the system. Problems with an account are blamed on the last transaction
+// that changed it. The total, and accounts the ledger has never changed,
+// are blamed on the last transaction in the ledger.
+func (c *Checker) CheckAll() []Violation {
+	violations, _ := c.checkLedger()
+
+	for _, userID := range c.accounts.Names() {
+		blame, found := c.lastChanges[userID]
+		if !found {
+			blame = c.latest
+		}
+		violations = append(violations, c.newProblems(userID, c.checkAccount(userID, blame))...)
+		c.count(userID)
+	}
+
+	return append(violations, c.checkTotal(c.latest)...)
+}
+
+// count : Updates the total cash with the user's balance
+func (c *Checker) count(userID string) {
+	c.total.Sub(c.counted[userID])
+	delete(c.counted, userID)
+
+	if account := c.accounts.GetAccount(userID); account != nil {
+		c.total.Add(account.Balance)
+		c.counted[userID] = account.Balance
+	}
+}
+
+// checkTotal : Checks the total cash in the accounts against the ledger
+func (c *Checker) checkTotal(blame lastChange) []Violation {
+	expected := c.added
+	expected.Add(c.credited)
+	if err := expected.Sub(c.debited); err == nil && c.total.String() == expected.String() {
+		return c.newProblems("", nil)
+	}
+
+	return c.newProblems("", []Violation{{
+		TransactionNum: blame.TransactionNum,
+		Command:        blame.Command,
+		Message: fmt.Sprintf(
+			"Accounts hold %s but ADDs of %s plus credits of %s less debits of %s should leave %s",
+			c.total, c.added, c.credited, c.debited, expected,
+		),
+	}})
+}
+
+// newProblems : The violations that weren't found the last time the user,
+// or the total cash for "", was checked
+func (c *Checker) newProblems(userID string, violations []Violation) []Violation {
+	var fresh []Violation
+	found := make(map[string]bool)
+	for _, v := range violations {
+		found[v.Message] = true
+		if !c.open[userID][v.Message] {
+			fresh = append(fresh, v)
+		}
+	}
+	c.open[userID] = found
+	return fresh
+}
+
+// checkLedger : Replays the new ledger entries, checking each against the
+// running balance and holdings. Returns the users the entries changed.
+func (c *Checker) checkLedger() ([]Violation, []string) {
+	entries := c.accounts.Ledger.Since(c.ledgerChecked)
+	c.ledgerChecked += len(entries)
+
+	var violations []Violation
+	var changed []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		blame := lastChange{entry.TransactionNum, entry.Command}
+		if !seen[entry.UserID] {
+			seen[entry.UserID] = true
+			changed = append(changed, entry.UserID)
+		}
+		c.lastChanges[entry.UserID] = blame
+		c.latest = blame
+		report := func(format string, args ...interface{}) {
+			violations = append(violations, Violation{
+				TransactionNum: blame.TransactionNum,
+				Command:        blame.Command,
+				UserID:         entry.UserID,
+				Message:        fmt.Sprintf(format, args...),
+			})
+		}
+
+		balance := c.balances[entry.UserID]
+		holdings, found := c.holdings[entry.UserID]
+		if !found {
+			holdings = make(accounts.Portfolio)
+			c.holdings[entry.UserID] = holdings
+		}
+		held := holdings[entry.Stock]
+		var err error
+
+		switch entry.Kind {
+		case accounts.Credit:
+			balance.Add(entry.Amount)
+			if entry.Command == commands.Add {
+				c.added.Add(entry.Amount)
+			} else {
+				c.credited.Add(entry.Amount)
+			}
+		case accounts.Debit:
+			c.debited.Add(entry.Amount)
+			if err := balance.Sub(entry.Amount); err != nil {
+				report("Debit of %s is more than the balance of %s", entry.Amount, balance)
+			}
+		case accounts.ShareGrant:
+			if holdings[entry.Stock], err = held.Add(entry.Units); err != nil {
+				report("Added %d %s to a holding of %d", entry.Units, entry.Stock, held)
+			}
+		case accounts.ShareRemoval:
+			if holdings[entry.Stock], err = held.Sub(entry.Units); err != nil {
+				report("Removed %d %s but only held %d", entry.Units, entry.Stock, held)
+			}
+		}
+
+		// Carry on from what the ledger recorded so one problem is only
+		// reported once
+		if balance.String() != entry.Balance.String() {
+			report("Ledger balance is %s but the entries add up to %s", entry.Balance, balance)
+		}
+		if entry.Stock != "" && holdings[entry.Stock] != entry.Holding {
+			report("Ledger holds %d %s but the entries add up to %d",
+				entry.Holding, entry.Stock, holdings[entry.Stock])
+			holdings[entry.Stock] = entry.Holding
+		}
+		c.balances[entry.UserID] = entry.Balance
+	}
+
+	return violations, changed
+}
+
+// checkAccount : Checks a user's account against the ledger and their
+// pending buys and buy triggers
+func (c *Checker) checkAccount(userID string, blame lastChange) []Violation {
+	account := c.accounts.GetAccount(userID)
+	if account == nil {
+		return nil
+	}
+
+	var violations []Violation
+	report := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{
+			TransactionNum: blame.TransactionNum,
+			Command:        blame.Command,
+			UserID:         userID,
+			Message:        fmt.Sprintf(format, args...),
+		})
+	}
+
+	// Balances
+	reserved := account.Reserved()
+	available := account.Balance
+	if account.Balance.ToFloat() < 0 {
+		report("Balance is negative: %s", account.Balance)
+	} else if err := available.Sub(reserved); err != nil {
+		report("Reserved funds of %s exceed the balance of %s", reserved, account.Balance)
+	}
+	if ledgerBalance := c.balances[userID]; account.Balance.String() != ledgerBalance.String() {
+		report("Balance is %s but the ledger says %s", account.Balance, ledgerBalance)
+	}
+
+	// Portfolio
+	for _, stock := range stocks(account.Portfolio, c.holdings[userID]) {
+		if held, recorded := account.Portfolio[stock], c.holdings[userID][stock]; held != recorded {
+			report("Portfolio holds %d %s but the ledger says %d", held, stock, recorded)
+		}
+	}
+
+	// Reservations. Every pending buy and buy trigger should hold exactly
+	// its amount, and nothing else should hold anything.
+	expected := make(map[accounts.ReservationID]currency.Currency)
+	for _, buy := range account.BuyQueue {
+		expected[buy.ReservationID] = buy.Cost()
+	}
+	for _, autoBuys := range c.autoBuys.GetUserAutorequests(userID) {
+		for _, autoBuy := range autoBuys {
+			expected[autoBuy.ReservationID] = autoBuy.Amount
+		}
+	}
+
+	var expectedTotal currency.Currency
+	for _, amount := range expected {
+		expectedTotal.Add(amount)
+	}
+	if reserved.String() != expectedTotal.String() {
+		report("Reserved funds are %s but pending buys and buy triggers hold %s", reserved, expectedTotal)
+	}
+
+	held := account.Reservations()
+	for id, amount := range expected {
+		if r, found := held[id]; !found {
+			report("Reservation %d for %s is missing", id, amount)
+		} else if r.Amount.String() != amount.String() {
+			report("Reservation %d holds %s for %s but should hold %s", id, r.Amount, r.Owner, amount)
+		}
+	}
+	for id, r := range held {
+		if _, found := expected[id]; !found {
+			report("Reservation %d holds %s for %s, which is no longer pending", id, r.Amount, r.Owner)
+		}
+	}
+
+	return violations
+}
+
+// union : Every user in either list, in the order first seen
+func union(a, b []string) []string {
+	var all []string
+	seen := make(map[string]bool)
+	for _, userIDs := range [][]string{a, b} {
+		for _, userID := range userIDs {
+			if !seen[userID] {
+				seen[userID] = true
+				all = append(all, userID)
+			}
+		}
+	}
+	return all
+}
+
+// stocks : Every stock in either portfolio, sorted
+func stocks(portfolios ...accounts.Portfolio) []string {
+	seen := make(map[string]bool)
+	var all []string
+	for _, p := range portfolios {
+		for stock := range p {
+			if !seen[stock] {
+				seen[stock] = true
+				all = append(all, stock)
+			}
+		}
+	}
+	sort.Strings(all)
+	return all
+}
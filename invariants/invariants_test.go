@@ -0,0 +1,123 @@
+package invariants_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/invariants"
+)
+
+// newChecker : alice and bob ADD funds in transactions 1 and 2, then
+// alice spends some in transaction 3
+func newChecker(t *testing.T) (*accounts.AccountStore, *invariants.Checker) {
+	as := accounts.NewAccountStore()
+	for _, userID := range []string{"alice", "bob"} {
+		if err := as.CreateAccount(userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	as.GetAccount("alice").AddFunds(accounts.Tx{ID: 1, Command: commands.Add}, testutil.Money(t, "100.00"))
+	as.GetAccount("bob").AddFunds(accounts.Tx{ID: 2, Command: commands.Add}, testutil.Money(t, "50.00"))
+	if err := as.GetAccount("alice").RemoveFunds(accounts.Tx{ID: 3, Command: commands.CommitBuy}, testutil.Money(t, "20.00")); err != nil {
+		t.Fatal(err)
+	}
+
+	return as, invariants.NewChecker(as, autorequests.NewAutoRequestStore(), autorequests.NewAutoRequestStore())
+}
+
+// checkBlame : Every violation is blamed on a real transaction, and the
+// ones for userID on transactionNum and command
+func checkBlame(t *testing.T, violations []invariants.Violation, userID string, transactionNum int, command commands.CommandType) {
+	found := false
+	for _, v := range violations {
+		if v.TransactionNum <= 0 {
+			t.Errorf("%s isn't blamed on a transaction", v)
+		}
+		if v.UserID != userID {
+			continue
+		}
+		found = true
+		if v.TransactionNum != transactionNum || v.Command != command {
+			t.Errorf("%s should be blamed on [%d] %s", v, transactionNum, command)
+		}
+	}
+	if !found {
+		t.Errorf("no violation for %q in %v", userID, violations)
+	}
+}
+
+func isTotal(v invariants.Violation) bool {
+	return v.UserID == "" && strings.HasPrefix(v.Message, "Accounts hold")
+}
+
+func TestCheckAllBlamesLastChange(t *testing.T) {
+	as, checker := newChecker(t)
+
+	// Changed behind the ledger's back
+	as.GetAccount("bob").Balance.Add(testutil.Money(t, "10.00"))
+
+	violations := checker.CheckAll()
+	checkBlame(t, violations, "bob", 2, commands.Add)
+	checkBlame(t, violations, "", 3, commands.CommitBuy)
+}
+
+func TestCheckAllBlamesAccountsWithoutLedgerOnLastTransaction(t *testing.T) {
+	as, checker := newChecker(t)
+
+	if err := as.CreateAccount("carol"); err != nil {
+		t.Fatal(err)
+	}
+	as.GetAccount("carol").Balance.Add(testutil.Money(t, "5.00"))
+
+	violations := checker.CheckAll()
+	checkBlame(t, violations, "carol", 3, commands.CommitBuy)
+	checkBlame(t, violations, "", 3, commands.CommitBuy)
+}
+
+func TestCheckUsersChecksTotalCash(t *testing.T) {
+	as, checker := newChecker(t)
+	if violations := checker.CheckAll(); len(violations) != 0 {
+		t.Fatalf("fresh accounts have problems: %v", violations)
+	}
+
+	add := commands.Command{ID: 4, Name: commands.Add, UserID: "alice"}
+	as.GetAccount("alice").AddFunds(accounts.Tx{ID: add.ID, Command: add.Name}, testutil.Money(t, "5.00"))
+	if violations := checker.CheckUsers(add, []string{"alice"}); len(violations) != 0 {
+		t.Fatalf("ADD caused problems: %v", violations)
+	}
+
+	// Losing bob's account loses his cash. There's no account left to
+	// find a problem with, only the total.
+	cancel := commands.Command{ID: 5, Name: commands.CancelBuy, UserID: "bob"}
+	as.RemoveAccount("bob")
+	violations := checker.CheckUsers(cancel, []string{"bob"})
+	if len(violations) != 1 || !isTotal(violations[0]) {
+		t.Fatalf("got %v, want a wrong total", violations)
+	}
+	checkBlame(t, violations, "", 5, commands.CancelBuy)
+
+	// It's only reported once
+	quote := commands.Command{ID: 6, Name: commands.Quote, UserID: "alice"}
+	if violations := checker.CheckUsers(quote, []string{"alice"}); len(violations) != 0 {
+		t.Errorf("the wrong total was reported again: %v", violations)
+	}
+}
+
+func TestCheckUsersCountsUsersChangedOutsideTheCommand(t *testing.T) {
+	as, checker := newChecker(t)
+	checker.CheckAll()
+
+	// A fill for bob lands between commands
+	fill := accounts.Tx{ID: 1000000000, Command: commands.Sell}
+	as.GetAccount("bob").AddFunds(fill, testutil.Money(t, "7.00"))
+
+	quote := commands.Command{ID: 4, Name: commands.Quote, UserID: "alice"}
+	if violations := checker.CheckUsers(quote, []string{"alice"}); len(violations) != 0 {
+		t.Errorf("a fill between commands looks like a problem: %v", violations)
+	}
+}
@@ -0,0 +1,109 @@
+// mockquoteserver : A stand-in for the course quoteserver. Speaks the same
+// "stock,user" -> "price,stock,user,time,key" line protocol so workloads
+// can be run without access to the real one.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/distributeddesigns/currency"
+	"github.com/op/go-logging"
+
+	"github.com/distributeddesigns/milestone1/quotecache"
+)
+
+var (
+	consoleLog = logging.MustGetLogger("console")
+
+	address  = flag.String("addr", "localhost:4443", "Address to listen on")
+	prices   = flag.String("prices", "", "Starting prices, e.g. ABC=12.34,DEF=5.00")
+	latency  = flag.Duration("latency", 0, "Delay before each response, e.g. 250ms")
+	walkStep = flag.Float64("walk", 0, "Max fractional price change per quote, e.g. 0.05")
+	seed     = flag.Int64("seed", 1, "Seed for the random walk")
+)
+
+func main() {
+	flag.Parse()
+
+	startingPrices, err := parsePrices(*prices)
+	if err != nil {
+		consoleLog.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	fakeSource := quotecache.NewFakeQuoteSource(startingPrices, *seed)
+	fakeSource.Latency = *latency
+	fakeSource.WalkStep = *walkStep
+
+	listener, err := net.Listen("tcp", *address)
+	if err != nil {
+		consoleLog.Critical(err.Error())
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	consoleLog.Noticef("Mock quoteserver listening on %s", *address)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			consoleLog.Error(err.Error())
+			continue
+		}
+		go handleConnection(conn, fakeSource)
+	}
+}
+
+// Answers a single request then hangs up, like the real quoteserver
+func handleConnection(conn net.Conn, qs quotecache.QuoteSource) {
+	defer conn.Close()
+
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		consoleLog.Warningf("Bad read from %s: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	userID, stock, err := quotecache.ParseRequest(request)
+	if err != nil {
+		consoleLog.Warningf("Bad request from %s: %q", conn.RemoteAddr(), request)
+		return
+	}
+
+	quote, err := qs.FetchQuote(userID, stock)
+	if err != nil {
+		consoleLog.Error(err.Error())
+		return
+	}
+
+	consoleLog.Infof("Quoted %s for %s at %s", stock, userID, quote.Price)
+
+	conn.Write([]byte(quotecache.FormatResponse(quote)))
+}
+
+// Converts "ABC=12.34,DEF=5.00" to a price map
+func parsePrices(s string) (map[string]currency.Currency, error) {
+	parsed := make(map[string]currency.Currency)
+	if s == "" {
+		return parsed, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad price `%s`. Expected STOCK=price", pair)
+		}
+		price, err := currency.NewFromString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Bad price `%s`. Expected STOCK=price", pair)
+		}
+		parsed[parts[0]] = price
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,637 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/repository"
+)
+
+var (
+	consoleLog = logging.MustGetLogger("console")
+
+	errTxDone = errors.New("Transaction has already been committed or rolled back")
+)
+
+const (
+	walFilename      = "accounts.wal"
+	snapshotFilename = "accounts.snapshot"
+	ledgerFilename   = "accounts.ledger"
+)
+
+// SyncPolicy : When the write-ahead log is flushed to disk
+type SyncPolicy int
+
+// SyncPolicy enum!
+const (
+	// SyncAlways : fsync after every command. Nothing is lost on power failure.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval : fsync at most once per Options.SyncInterval. A power
+	// failure loses up to that much work. A crash of the process loses nothing.
+	SyncInterval
+	// SyncNever : Leave flushing to the OS
+	SyncNever
+)
+
+// ToSyncPolicy : Convert string -> SyncPolicy enum
+func ToSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncAlways, errors.New("Not a valid sync policy")
+}
+
+// Options : How a Journal writes to disk
+type Options struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// Commands between snapshots. The log is emptied after each one.
+	// 0 only snapshots on Close.
+	SnapshotEvery int
+}
+
+// Journal : An AccountRepository kept in files in a directory. Every
+// committed transaction is appended to a write-ahead log as the state of
+// the users it wrote. Snapshots of every user are taken periodically so
+// the log stays short. The ledger only grows, so at each snapshot its new
+// entries are appended to a ledger file rather than rewritten.
+//
+// The latest saved record of each user is kept to write snapshots from.
+// The ledger isn't; it's read back from the ledger file. Transactions run
+// one at a time.
+type Journal struct {
+	Options
+
+	dir string
+	wal *os.File
+
+	seq             uint64
+	lastTransaction int
+	nextFill        int
+	users           map[string]userRecord
+	// Entries in the ledger file, and ones only in the log so far
+	ledgerSaved   int
+	ledgerPending []ledgerEntry
+	sinceSnapshot int
+	lastSync      time.Time
+
+	// Held by the open transaction
+	mutex sync.Mutex
+}
+
+// Open : Reads the latest snapshot and the log in dir, creating it if
+// needed, then starts logging to it.
+func Open(dir string, opts Options) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		Options:  opts,
+		dir:      dir,
+		users:    make(map[string]userRecord),
+		lastSync: time.Now(),
+	}
+
+	ledgerLen, err := j.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if err := j.checkLedger(ledgerLen); err != nil {
+		return nil, err
+	}
+	if err := j.replayLog(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(j.path(walFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.wal = wal
+
+	return j, nil
+}
+
+// Begin : Starts a transaction. Blocks until the previous one ends.
+func (j *Journal) Begin() (repository.Tx, error) {
+	j.mutex.Lock()
+	return &journalTx{
+		j:               j,
+		users:           make(map[string]userRecord),
+		lastTransaction: j.lastTransaction,
+		nextFill:        j.nextFill,
+	}, nil
+}
+
+// Close : Takes a final snapshot and closes the log
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := j.snapshot(); err != nil {
+		j.wal.Close()
+		return err
+	}
+	return j.wal.Close()
+}
+
+func (j *Journal) path(filename string) string {
+	return filepath.Join(j.dir, filename)
+}
+
+// commit : Writes a transaction's record to the log and applies it.
+// Caller must hold the mutex.
+func (j *Journal) commit(rec record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	switch {
+	case j.Sync == SyncAlways,
+		j.Sync == SyncInterval && time.Since(j.lastSync) >= j.SyncInterval:
+		if err := j.wal.Sync(); err != nil {
+			return err
+		}
+		j.lastSync = time.Now()
+	}
+
+	j.apply(rec)
+	j.sinceSnapshot++
+
+	if j.SnapshotEvery > 0 && j.sinceSnapshot >= j.SnapshotEvery {
+		return j.snapshot()
+	}
+
+	return nil
+}
+
+// snapshot : Writes every user to a new snapshot file then empties the
+// log. The snapshot is swapped in with a rename so there is always a
+// complete one on disk. Caller must hold the mutex.
+func (j *Journal) snapshot() error {
+	if err := j.saveLedger(); err != nil {
+		return err
+	}
+
+	rec := record{
+		Seq:            j.seq,
+		TransactionNum: j.lastTransaction,
+		NextFill:       j.nextFill,
+		Users:          []userRecord{},
+		LedgerLen:      j.ledgerSaved,
+	}
+	for _, userID := range j.userIDs() {
+		rec.Users = append(rec.Users, j.users[userID])
+	}
+
+	tmpPath := j.path(snapshotFilename + ".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tmp).Encode(rec); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path(snapshotFilename)); err != nil {
+		return err
+	}
+	if err := syncDir(j.dir); err != nil {
+		return err
+	}
+
+	// Everything in the log is in the snapshot now. If we crash before
+	// this, replay skips the records the snapshot already covers.
+	if err := j.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := j.wal.Sync(); err != nil {
+		return err
+	}
+
+	consoleLog.Infof("Snapshot taken at transaction %d", j.lastTransaction)
+	j.sinceSnapshot = 0
+	j.lastSync = time.Now()
+
+	return nil
+}
+
+// userIDs : Everyone with a saved record, sorted
+func (j *Journal) userIDs() []string {
+	users := make([]string, 0, len(j.users))
+	for userID := range j.users {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// saveLedger : Appends the ledger entries only in the log so far to the
+// ledger file. Caller must hold the mutex.
+func (j *Journal) saveLedger() error {
+	f, err := os.OpenFile(j.path(ledgerFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, le := range j.ledgerPending {
+		if err := encoder.Encode(le); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	j.ledgerSaved += len(j.ledgerPending)
+	j.ledgerPending = nil
+
+	return nil
+}
+
+// loadSnapshot : Applies the snapshot, if there is one. Returns how many
+// entries of the ledger file it covers.
+func (j *Journal) loadSnapshot() (int, error) {
+	f, err := os.Open(j.path(snapshotFilename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var rec record
+	if err := json.NewDecoder(f).Decode(&rec); err != nil {
+		return 0, err
+	}
+	j.apply(rec)
+	return rec.LedgerLen, nil
+}
+
+// checkLedger : Makes sure the ledger file has the first n entries.
+// Anything after them was saved by a snapshot that didn't finish and is
+// cut off; the log still has those entries.
+func (j *Journal) checkLedger(n int) error {
+	f, err := os.OpenFile(j.path(ledgerFilename), os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		if n > 0 {
+			return errors.New("Ledger file is missing")
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var goodBytes int64
+	for counted := 0; counted < n; counted++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return errors.New("Ledger file is shorter than the snapshot")
+		}
+		goodBytes += int64(len(line))
+	}
+
+	j.ledgerSaved = n
+
+	return f.Truncate(goodBytes)
+}
+
+// readLedger : Every entry in the ledger file
+func (j *Journal) readLedger() ([]accounts.LedgerEntry, error) {
+	entries := []accounts.LedgerEntry{}
+
+	f, err := os.Open(j.path(ledgerFilename))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for len(entries) < j.ledgerSaved {
+		var le ledgerEntry
+		if err := decoder.Decode(&le); err != nil {
+			return nil, err
+		}
+		entry, err := le.ledgerEntry()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// replayLog : Applies every log record newer than the snapshot. A partly
+// written record at the end, left by a crash mid-write, is cut off.
+func (j *Journal) replayLog() error {
+	f, err := os.OpenFile(j.path(walFilename), os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var goodBytes int64
+	replayed := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				consoleLog.Warningf("Dropping partial record at the end of %s", f.Name())
+				return f.Truncate(goodBytes)
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			consoleLog.Warningf("Dropping unreadable records at the end of %s", f.Name())
+			return f.Truncate(goodBytes)
+		}
+		goodBytes += int64(len(line))
+
+		if rec.Seq <= j.seq {
+			// Already in the snapshot
+			continue
+		}
+		j.apply(rec)
+		replayed++
+	}
+
+	consoleLog.Infof("Replayed %d records from %s", replayed, f.Name())
+
+	return nil
+}
+
+// apply : Makes the users in a record the latest saved ones. Users left
+// with nothing are dropped.
+func (j *Journal) apply(rec record) {
+	for _, ur := range rec.Users {
+		if ur.isEmpty() {
+			delete(j.users, ur.UserID)
+		} else {
+			j.users[ur.UserID] = ur
+		}
+	}
+
+	j.ledgerPending = append(j.ledgerPending, rec.Ledger...)
+	j.seq = rec.Seq
+	j.lastTransaction = rec.TransactionNum
+	j.nextFill = rec.NextFill
+}
+
+// journalTx : Holds writes, as records, until Commit logs them. The
+// journal is locked for as long as the transaction is open.
+type journalTx struct {
+	j               *Journal
+	users           map[string]userRecord
+	ledger          []ledgerEntry
+	lastTransaction int
+	nextFill        int
+	done            bool
+}
+
+// user : The user's record as of this transaction
+func (tx *journalTx) user(userID string) userRecord {
+	if ur, found := tx.users[userID]; found {
+		return ur
+	}
+	if ur, found := tx.j.users[userID]; found {
+		return ur
+	}
+	return userRecord{UserID: userID}
+}
+
+func (tx *journalTx) Users() ([]string, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+
+	seen := make(map[string]bool)
+	for _, userMap := range []map[string]userRecord{tx.j.users, tx.users} {
+		for userID := range userMap {
+			seen[userID] = !tx.user(userID).isEmpty()
+		}
+	}
+
+	users := []string{}
+	for userID, include := range seen {
+		if include {
+			users = append(users, userID)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (tx *journalTx) Account(userID string) (accounts.Snapshot, bool, error) {
+	if tx.done {
+		return accounts.Snapshot{}, false, errTxDone
+	}
+
+	ar := tx.user(userID).Account
+	if ar == nil {
+		return accounts.Snapshot{}, false, nil
+	}
+	s, err := ar.snapshot()
+	if err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	return s, true, nil
+}
+
+func (tx *journalTx) PutAccount(userID string, s accounts.Snapshot) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	ur := tx.user(userID)
+	ur.Account = toAccountRecord(s)
+	tx.users[userID] = ur
+	return nil
+}
+
+func (tx *journalTx) Triggers(side repository.Side, userID string) (map[string][]autorequests.AutoRequest, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+
+	ur := tx.user(userID)
+	if side == repository.Buys {
+		return fromAutoRequests(ur.BuyTriggers)
+	}
+	return fromAutoRequests(ur.SellTriggers)
+}
+
+func (tx *journalTx) PutTriggers(side repository.Side, userID string, requests map[string][]autorequests.AutoRequest) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	ur := tx.user(userID)
+	if side == repository.Buys {
+		ur.BuyTriggers = toAutoRequests(requests)
+	} else {
+		ur.SellTriggers = toAutoRequests(requests)
+	}
+	tx.users[userID] = ur
+	return nil
+}
+
+func (tx *journalTx) Ledger() ([]accounts.LedgerEntry, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+
+	entries, err := tx.j.readLedger()
+	if err != nil {
+		return nil, err
+	}
+	for _, pending := range [][]ledgerEntry{tx.j.ledgerPending, tx.ledger} {
+		for _, le := range pending {
+			entry, err := le.ledgerEntry()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (tx *journalTx) AppendLedger(entries []accounts.LedgerEntry) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.ledger = append(tx.ledger, toLedgerEntries(entries)...)
+	return nil
+}
+
+func (tx *journalTx) LastTransaction() (int, error) {
+	if tx.done {
+		return 0, errTxDone
+	}
+
+	return tx.lastTransaction, nil
+}
+
+func (tx *journalTx) SetLastTransaction(txn int) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.lastTransaction = txn
+	return nil
+}
+
+func (tx *journalTx) NextFill() (int, error) {
+	if tx.done {
+		return 0, errTxDone
+	}
+
+	return tx.nextFill, nil
+}
+
+func (tx *journalTx) SetNextFill(txn int) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.nextFill = txn
+	return nil
+}
+
+// Commit : Logs everything the transaction wrote as one record
+func (tx *journalTx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+
+	rec := record{
+		Seq:            tx.j.seq + 1,
+		TransactionNum: tx.lastTransaction,
+		NextFill:       tx.nextFill,
+		Users:          []userRecord{},
+		Ledger:         tx.ledger,
+	}
+	userIDs := make([]string, 0, len(tx.users))
+	for userID := range tx.users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	for _, userID := range userIDs {
+		rec.Users = append(rec.Users, tx.users[userID])
+	}
+
+	err := tx.j.commit(rec)
+	tx.end()
+	return err
+}
+
+func (tx *journalTx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.end()
+	return nil
+}
+
+func (tx *journalTx) end() {
+	tx.done = true
+	tx.j.mutex.Unlock()
+}
+
+// syncDir : fsyncs a directory so a rename inside it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
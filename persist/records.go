@@ -0,0 +1,299 @@
+package persist
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+)
+
+// record : One line of the write-ahead log, or a whole snapshot. Holds the
+// full state of every user a command touched and the ledger entries it
+// made. A snapshot holds every user and, instead of the ledger, how many
+// entries of the ledger file it covers.
+type record struct {
+	Seq            uint64        `json:"seq"`
+	TransactionNum int           `json:"transactionNum"`
+	NextFill       int           `json:"nextFill,omitempty"`
+	Users          []userRecord  `json:"users"`
+	Ledger         []ledgerEntry `json:"ledger,omitempty"`
+	LedgerLen      int           `json:"ledgerLen,omitempty"`
+}
+
+// userRecord : Everything we keep for a user. Account is nil if they
+// don't have one.
+type userRecord struct {
+	UserID       string                   `json:"userID"`
+	Account      *accountRecord           `json:"account,omitempty"`
+	BuyTriggers  map[string][]autoRequest `json:"buyTriggers,omitempty"`
+	SellTriggers map[string][]autoRequest `json:"sellTriggers,omitempty"`
+}
+
+// isEmpty : True if there's nothing left to keep for the user
+func (ur userRecord) isEmpty() bool {
+	return ur.Account == nil && len(ur.BuyTriggers) == 0 && len(ur.SellTriggers) == 0
+}
+
+// Money is written as "12.34" so it reads back exactly
+type accountRecord struct {
+	Balance           string                     `json:"balance"`
+	Portfolio         map[string]accounts.Shares `json:"portfolio"`
+	Lots              map[string][]lot           `json:"lots,omitempty"`
+	Realized          map[string]profitLoss      `json:"realized,omitempty"`
+	BuyQueue          []action                   `json:"buyQueue"`
+	SellQueue         []action                   `json:"sellQueue"`
+	Reservations      []reservation              `json:"reservations"`
+	LastReservationID uint64                     `json:"lastReservationID"`
+}
+
+type action struct {
+	Time          time.Time `json:"time"`
+	Stock         string    `json:"stock"`
+	Units         uint      `json:"units"`
+	UnitPrice     string    `json:"unitPrice"`
+	ReservationID uint64    `json:"reservationID,omitempty"`
+}
+
+type lot struct {
+	Units     accounts.Shares `json:"units"`
+	UnitPrice string          `json:"unitPrice"`
+	Time      time.Time       `json:"time"`
+}
+
+type profitLoss struct {
+	Gain string `json:"gain"`
+	Loss string `json:"loss"`
+}
+
+type reservation struct {
+	ID     uint64 `json:"id"`
+	Amount string `json:"amount"`
+	Owner  string `json:"owner"`
+}
+
+type autoRequest struct {
+	ID            int             `json:"id"`
+	State         int             `json:"state"`
+	Amount        string          `json:"amount"`
+	Trigger       string          `json:"trigger"`
+	ReservationID uint64          `json:"reservationID,omitempty"`
+	Units         accounts.Shares `json:"units,omitempty"`
+}
+
+type ledgerEntry struct {
+	Time           time.Time       `json:"time"`
+	UserID         string          `json:"userID"`
+	TransactionNum int             `json:"transactionNum"`
+	Command        string          `json:"command"`
+	Kind           int             `json:"kind"`
+	Amount         string          `json:"amount"`
+	Stock          string          `json:"stock,omitempty"`
+	Units          accounts.Shares `json:"units,omitempty"`
+	Balance        string          `json:"balance"`
+	Holding        accounts.Shares `json:"holding,omitempty"`
+}
+
+func toAccountRecord(s accounts.Snapshot) *accountRecord {
+	ar := accountRecord{
+		Balance:           accounts.FormatMoney(s.Balance),
+		Portfolio:         s.Portfolio,
+		BuyQueue:          toActions(s.BuyQueue),
+		SellQueue:         toActions(s.SellQueue),
+		Lots:              make(map[string][]lot),
+		Realized:          make(map[string]profitLoss),
+		Reservations:      []reservation{},
+		LastReservationID: uint64(s.LastReservationID),
+	}
+	for stock, stockLots := range s.Lots {
+		for _, l := range stockLots {
+			ar.Lots[stock] = append(ar.Lots[stock], lot{l.Units, accounts.FormatMoney(l.UnitPrice), l.Time})
+		}
+	}
+	for stock, pl := range s.Realized {
+		ar.Realized[stock] = profitLoss{accounts.FormatMoney(pl.Gain), accounts.FormatMoney(pl.Loss)}
+	}
+	for _, r := range s.Reservations {
+		ar.Reservations = append(ar.Reservations, reservation{uint64(r.ID), accounts.FormatMoney(r.Amount), r.Owner})
+	}
+	return &ar
+}
+
+func toActions(queue accounts.ActionQueue) []action {
+	out := []action{}
+	for _, act := range queue {
+		out = append(out, action{
+			Time:          act.Time,
+			Stock:         act.Stock,
+			Units:         act.Units,
+			UnitPrice:     accounts.FormatMoney(act.UnitPrice),
+			ReservationID: uint64(act.ReservationID),
+		})
+	}
+	return out
+}
+
+func (ar *accountRecord) snapshot() (accounts.Snapshot, error) {
+	balance, err := accounts.ParseMoney(ar.Balance)
+	if err != nil {
+		return accounts.Snapshot{}, err
+	}
+
+	s := accounts.Snapshot{
+		Balance:           balance,
+		Portfolio:         make(accounts.Portfolio),
+		Lots:              make(map[string][]accounts.Lot),
+		Realized:          make(map[string]accounts.ProfitLoss),
+		LastReservationID: accounts.ReservationID(ar.LastReservationID),
+	}
+	for stock, stockLots := range ar.Lots {
+		for _, l := range stockLots {
+			unitPrice, err := accounts.ParseMoney(l.UnitPrice)
+			if err != nil {
+				return accounts.Snapshot{}, err
+			}
+			s.Lots[stock] = append(s.Lots[stock], accounts.Lot{Units: l.Units, UnitPrice: unitPrice, Time: l.Time})
+		}
+	}
+	for stock, pl := range ar.Realized {
+		var realized accounts.ProfitLoss
+		if realized.Gain, err = accounts.ParseMoney(pl.Gain); err != nil {
+			return accounts.Snapshot{}, err
+		}
+		if realized.Loss, err = accounts.ParseMoney(pl.Loss); err != nil {
+			return accounts.Snapshot{}, err
+		}
+		s.Realized[stock] = realized
+	}
+
+	for stock, units := range ar.Portfolio {
+		s.Portfolio[stock] = units
+	}
+	if s.BuyQueue, err = fromActions(ar.BuyQueue); err != nil {
+		return accounts.Snapshot{}, err
+	}
+	if s.SellQueue, err = fromActions(ar.SellQueue); err != nil {
+		return accounts.Snapshot{}, err
+	}
+	for _, r := range ar.Reservations {
+		amount, err := accounts.ParseMoney(r.Amount)
+		if err != nil {
+			return accounts.Snapshot{}, err
+		}
+		s.Reservations = append(s.Reservations, accounts.Reservation{
+			ID:     accounts.ReservationID(r.ID),
+			Amount: amount,
+			Owner:  r.Owner,
+		})
+	}
+
+	return s, nil
+}
+
+func fromActions(actions []action) (accounts.ActionQueue, error) {
+	queue := accounts.ActionQueue{}
+	for _, act := range actions {
+		unitPrice, err := accounts.ParseMoney(act.UnitPrice)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, accounts.Action{
+			Time:          act.Time,
+			Stock:         act.Stock,
+			Units:         act.Units,
+			UnitPrice:     unitPrice,
+			ReservationID: accounts.ReservationID(act.ReservationID),
+		})
+	}
+	return queue, nil
+}
+
+func toAutoRequests(requests map[string][]autorequests.AutoRequest) map[string][]autoRequest {
+	out := make(map[string][]autoRequest, len(requests))
+	for stock, stockRequests := range requests {
+		for _, request := range stockRequests {
+			out[stock] = append(out[stock], autoRequest{
+				ID:            request.ID,
+				State:         int(request.State),
+				Amount:        accounts.FormatMoney(request.Amount),
+				Trigger:       accounts.FormatMoney(request.Trigger),
+				ReservationID: uint64(request.ReservationID),
+				Units:         request.Units,
+			})
+		}
+	}
+	return out
+}
+
+func fromAutoRequests(requests map[string][]autoRequest) (map[string][]autorequests.AutoRequest, error) {
+	out := make(map[string][]autorequests.AutoRequest, len(requests))
+	for stock, stockRequests := range requests {
+		for _, request := range stockRequests {
+			amount, err := accounts.ParseMoney(request.Amount)
+			if err != nil {
+				return nil, err
+			}
+			trigger, err := accounts.ParseMoney(request.Trigger)
+			if err != nil {
+				return nil, err
+			}
+			out[stock] = append(out[stock], autorequests.AutoRequest{
+				ID:            request.ID,
+				State:         autorequests.State(request.State),
+				Amount:        amount,
+				Trigger:       trigger,
+				ReservationID: accounts.ReservationID(request.ReservationID),
+				Units:         request.Units,
+			})
+		}
+	}
+	return out, nil
+}
+
+func toLedgerEntries(entries []accounts.LedgerEntry) []ledgerEntry {
+	out := []ledgerEntry{}
+	for _, e := range entries {
+		out = append(out, ledgerEntry{
+			Time:           e.Time,
+			UserID:         e.UserID,
+			TransactionNum: e.TransactionNum,
+			Command:        e.Command.String(),
+			Kind:           int(e.Kind),
+			Amount:         accounts.FormatMoney(e.Amount),
+			Stock:          e.Stock,
+			Units:          e.Units,
+			Balance:        accounts.FormatMoney(e.Balance),
+			Holding:        e.Holding,
+		})
+	}
+	return out
+}
+
+func (le ledgerEntry) ledgerEntry() (accounts.LedgerEntry, error) {
+	command, err := commands.ToCommandType(le.Command)
+	if err != nil {
+		return accounts.LedgerEntry{}, fmt.Errorf("Bad command `%s` in journal", le.Command)
+	}
+	amount, err := accounts.ParseMoney(le.Amount)
+	if err != nil {
+		return accounts.LedgerEntry{}, err
+	}
+	balance, err := accounts.ParseMoney(le.Balance)
+	if err != nil {
+		return accounts.LedgerEntry{}, err
+	}
+
+	return accounts.LedgerEntry{
+		Time:           le.Time,
+		UserID:         le.UserID,
+		TransactionNum: le.TransactionNum,
+		Command:        command,
+		Kind:           accounts.EntryKind(le.Kind),
+		Amount:         amount,
+		Stock:          le.Stock,
+		Units:          le.Units,
+		Balance:        balance,
+		Holding:        le.Holding,
+	}, nil
+}
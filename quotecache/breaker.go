@@ -0,0 +1,117 @@
+package quotecache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen : Returned instead of calling the quote server while
+// the circuit breaker is open
+var ErrCircuitOpen = errors.New("quote server circuit breaker is open")
+
+// BreakerState : Where a CircuitBreaker is in its cycle
+type BreakerState int
+
+// BreakerState enum!
+const (
+	// BreakerClosed : Requests go through as normal
+	BreakerClosed BreakerState = iota
+	// BreakerOpen : Requests fail fast until the cooldown is over
+	BreakerOpen
+	// BreakerHalfOpen : One probe request is allowed through to see if
+	// the quote server has recovered
+	BreakerHalfOpen
+)
+
+var breakerStateNames = []string{
+	"closed",
+	"open",
+	"half-open",
+}
+
+// String representation of the BreakerState enum
+func (bs BreakerState) String() string {
+	return breakerStateNames[bs]
+}
+
+// CircuitBreaker : Stops calls to the quote server after FailureThreshold
+// consecutive failures. After Cooldown it lets a single probe through;
+// a successful probe closes the breaker, a failed one opens it again.
+type CircuitBreaker struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	state         BreakerState
+	failures      int
+	openedAt      time.Time
+	probeInFlight bool
+	mutex         sync.Mutex
+}
+
+// NewCircuitBreaker : A constructor that returns a closed breaker
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		Cooldown:         cooldown,
+	}
+}
+
+// State : The current state of the breaker
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.state
+}
+
+// Allow : True if a request may be sent to the quote server. Also returns
+// true for changed if deciding moved the breaker to a new state.
+func (cb *CircuitBreaker) Allow() (allowed, changed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.Cooldown {
+			return false, false
+		}
+		// Cooldown is over, send a probe
+		cb.state = BreakerHalfOpen
+		cb.probeInFlight = true
+		return true, true
+	case BreakerHalfOpen:
+		// Only one probe at a time
+		if cb.probeInFlight {
+			return false, false
+		}
+		cb.probeInFlight = true
+		return true, false
+	default:
+		return true, false
+	}
+}
+
+// Record : Updates the breaker with the result of a request that Allow()
+// let through. Returns true if the breaker changed state.
+func (cb *CircuitBreaker) Record(err error) (changed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	previous := cb.state
+	cb.probeInFlight = false
+
+	if err == nil {
+		cb.failures = 0
+		cb.state = BreakerClosed
+		return previous != cb.state
+	}
+
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.FailureThreshold {
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+	}
+
+	return previous != cb.state
+}
@@ -0,0 +1,97 @@
+package quotecache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// FakeQuoteSource : An in-process QuoteSource with predictable prices.
+// Stocks without a configured price get one derived from their symbol so
+// the same workload always sees the same quotes. With a non-zero WalkStep
+// each fetch moves the price by up to ±WalkStep (as a fraction of the
+// price), driven by a seeded generator so runs stay repeatable.
+type FakeQuoteSource struct {
+	Latency  time.Duration
+	WalkStep float64
+
+	prices map[string]currency.Currency
+	rng    *rand.Rand
+	mutex  sync.Mutex
+}
+
+// NewFakeQuoteSource : A constructor for a fake source with starting
+// prices. prices may be nil.
+func NewFakeQuoteSource(prices map[string]currency.Currency, seed int64) *FakeQuoteSource {
+	fqs := FakeQuoteSource{
+		prices: make(map[string]currency.Currency),
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+	for stock, price := range prices {
+		fqs.prices[stock] = price
+	}
+	return &fqs
+}
+
+// SetPrice : Fix the current price of a stock
+func (fqs *FakeQuoteSource) SetPrice(stock string, price currency.Currency) {
+	fqs.mutex.Lock()
+	defer fqs.mutex.Unlock()
+
+	fqs.prices[stock] = price
+}
+
+// FetchQuote : Makes up a quote for the stock
+func (fqs *FakeQuoteSource) FetchQuote(userID, stock string) (Quote, error) {
+	time.Sleep(fqs.Latency)
+
+	fqs.mutex.Lock()
+	defer fqs.mutex.Unlock()
+
+	price, found := fqs.prices[stock]
+	if !found {
+		price = defaultPrice(stock)
+	}
+
+	if fqs.WalkStep > 0 {
+		step := (fqs.rng.Float64()*2 - 1) * fqs.WalkStep
+		walked, err := currency.NewFromFloat(price.ToFloat() * (1 + step))
+		// Don't let the walk take the price to zero
+		if err == nil && walked.ToFloat() >= 0.01 {
+			price = walked
+		}
+	}
+	fqs.prices[stock] = price
+
+	now := time.Now()
+
+	return Quote{
+		UserID:    userID,
+		Stock:     stock,
+		Price:     price,
+		Timestamp: now,
+		Cryptokey: fakeCryptokey(userID, stock, now),
+		Server:    "FAKE",
+	}, nil
+}
+
+// defaultPrice : A stable price between $1.00 and $100.99 for any symbol
+func defaultPrice(stock string) currency.Currency {
+	h := fnv.New32a()
+	h.Write([]byte(stock))
+	cents := 100 + h.Sum32()%10000
+
+	price, _ := currency.NewFromFloat(float64(cents) / 100)
+	return price
+}
+
+func fakeCryptokey(userID, stock string, t time.Time) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s,%s,%d", stock, userID, t.Unix())
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,200 @@
+package quotecache
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint : A quoteserver we can ask for quotes. Name is what shows up in
+// the <server> field of the audit log.
+type Endpoint struct {
+	Name    string
+	Address string
+}
+
+// ParseEndpoints : Converts "QSRV1=host:port,host2:port" to endpoints.
+// Endpoints without a name are named after their address.
+func ParseEndpoints(s string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, "=")
+		switch {
+		case len(parts) == 1:
+			endpoints = append(endpoints, Endpoint{parts[0], parts[0]})
+		case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+			endpoints = append(endpoints, Endpoint{parts[0], parts[1]})
+		default:
+			return nil, fmt.Errorf("Bad quote server `%s`. Expected NAME=host:port or host:port", entry)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return nil, errors.New("No quote servers given")
+	}
+
+	return endpoints, nil
+}
+
+// SelectionStrategy : How a PoolQuoteSource picks which endpoint to ask first
+type SelectionStrategy int
+
+// SelectionStrategy enum!
+const (
+	// RoundRobin : Take turns so load is spread evenly
+	RoundRobin SelectionStrategy = iota
+	// LeastLatency : Prefer the endpoint that has been answering fastest
+	LeastLatency
+)
+
+// ToSelectionStrategy : Convert string -> SelectionStrategy enum
+func ToSelectionStrategy(s string) (SelectionStrategy, error) {
+	switch strings.ToLower(s) {
+	case "roundrobin":
+		return RoundRobin, nil
+	case "latency":
+		return LeastLatency, nil
+	}
+	return RoundRobin, errors.New("Not a valid selection strategy")
+}
+
+// endpointHealth : What we know about how an endpoint has been behaving
+type endpointHealth struct {
+	Endpoint
+	source *TCPQuoteSource
+
+	failures  int
+	downUntil time.Time
+	// Moving average of successful response times. Zero until the
+	// endpoint has answered once.
+	latency time.Duration
+}
+
+func (eh *endpointHealth) isDown(now time.Time) bool {
+	return now.Before(eh.downUntil)
+}
+
+// PoolQuoteSource : Spreads quote requests over several quoteservers.
+// An endpoint that fails FailureThreshold times in a row is skipped for
+// DownTime. If an endpoint fails the next one is tried straight away,
+// falling back to endpoints marked down only when nothing else is left.
+type PoolQuoteSource struct {
+	Strategy         SelectionStrategy
+	FailureThreshold int
+	DownTime         time.Duration
+
+	endpoints []*endpointHealth
+	next      int
+	mutex     sync.Mutex
+}
+
+// NewPoolQuoteSource : A constructor for a pool over the endpoints. Each
+// request to an endpoint gives up after timeout.
+func NewPoolQuoteSource(endpoints []Endpoint, strategy SelectionStrategy, timeout time.Duration) *PoolQuoteSource {
+	ps := PoolQuoteSource{
+		Strategy:         strategy,
+		FailureThreshold: 3,
+		DownTime:         time.Second * 30,
+	}
+	for _, ep := range endpoints {
+		ps.endpoints = append(ps.endpoints, &endpointHealth{
+			Endpoint: ep,
+			source:   NewTCPQuoteSource(ep.Address, timeout),
+		})
+	}
+	return &ps
+}
+
+// FetchQuote : Asks endpoints in order of preference until one answers
+func (ps *PoolQuoteSource) FetchQuote(userID, stock string) (Quote, error) {
+	err := errors.New("No quote servers configured")
+
+	for _, eh := range ps.candidates() {
+		start := time.Now()
+		var quote Quote
+		quote, err = eh.source.FetchQuote(userID, stock)
+		ps.record(eh, time.Since(start), err)
+
+		if err == nil {
+			quote.Server = eh.Name
+			return quote, nil
+		}
+
+		consoleLog.Warningf("Quote server %s failed: %s", eh.Name, err.Error())
+	}
+
+	return Quote{}, err
+}
+
+// candidates : Every endpoint, best choice first. Endpoints that are
+// down go at the back.
+func (ps *PoolQuoteSource) candidates() []*endpointHealth {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	now := time.Now()
+	var up, down []*endpointHealth
+
+	// Start from a different endpoint each time so round robin
+	// spreads the load.
+	count := len(ps.endpoints)
+	for i := 0; i < count; i++ {
+		eh := ps.endpoints[(ps.next+i)%count]
+		if eh.isDown(now) {
+			down = append(down, eh)
+		} else {
+			up = append(up, eh)
+		}
+	}
+	if count > 0 {
+		ps.next = (ps.next + 1) % count
+	}
+
+	if ps.Strategy == LeastLatency {
+		// Stable so ties keep their round robin order. Unmeasured
+		// endpoints go first so they get measured.
+		sort.Stable(byLatency(up))
+	}
+
+	return append(up, down...)
+}
+
+// record : Updates the health of an endpoint after a request
+func (ps *PoolQuoteSource) record(eh *endpointHealth, took time.Duration, err error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if err != nil {
+		eh.failures++
+		if eh.failures >= ps.FailureThreshold {
+			if !eh.isDown(time.Now()) {
+				consoleLog.Warningf("Marking quote server %s down for %s", eh.Name, ps.DownTime)
+			}
+			eh.downUntil = time.Now().Add(ps.DownTime)
+		}
+		return
+	}
+
+	eh.failures = 0
+	eh.downUntil = time.Time{}
+	if eh.latency == 0 {
+		eh.latency = took
+	} else {
+		// Weight recent responses more heavily
+		eh.latency = (eh.latency*3 + took) / 4
+	}
+}
+
+type byLatency []*endpointHealth
+
+func (bl byLatency) Len() int           { return len(bl) }
+func (bl byLatency) Swap(i, j int)      { bl[i], bl[j] = bl[j], bl[i] }
+func (bl byLatency) Less(i, j int) bool { return bl[i].latency < bl[j].latency }
@@ -1,19 +1,23 @@
 package quotecache
 
 import (
-	"bufio"
-	"errors"
+	"context"
 	"fmt"
-	"io"
-	"net"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/distributeddesigns/currency"
 
+	"github.com/op/go-logging"
+
 	"github.com/distributeddesigns/milestone1/auditlogger"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/expiry"
+)
+
+var (
+	consoleLog = logging.MustGetLogger("console")
 )
 
 // Quote : Stored response from the quoteserver
@@ -24,146 +28,354 @@ type Quote struct {
 	Timestamp     time.Time
 	Cryptokey     string
 	TransactionID int
+	// The quoteserver that answered
+	Server string
+	// Stale quotes are past their validity window. They're only handed
+	// out when the quote server can't be reached.
+	Stale bool
 }
 
 // IsExpired : True if the quotes timestamp is older than its validity window
 func (q Quote) IsExpired() bool {
-	expiry := q.Timestamp.Add(time.Second * 60)
-	return time.Now().After(expiry)
+	return expiry.IsExpired(q.Timestamp)
+}
+
+// cacheKey : Quotes are shared by every user asking about a stock. When
+// per-user caching is on the user is part of the key, so each user only
+// sees quotes fetched on their behalf.
+type cacheKey struct {
+	stock  string
+	userID string
+}
+
+// Cache : Recent quotes from a QuoteSource. Safe for concurrent use.
+type Cache struct {
+	source         QuoteSource
+	perUserCaching bool
+	retryPolicy    RetryPolicy
+	breaker        *CircuitBreaker
+	staleWindow    time.Duration
+
+	// quotes holds the latest quote for each key. e.g {"AAPL", ""}: QuoteInstance
+	quotes map[cacheKey]Quote
+	// inflight holds the quote server requests that haven't finished yet
+	inflight map[cacheKey]*fetchCall
+	// subscribers are told about every quote from the quote server
+	subscribers []func(Quote)
+	// Guards quotes, inflight and subscribers
+	mutex sync.RWMutex
+}
+
+// NewCache : A constructor that returns an empty cache that gets
+// fresh quotes from source
+func NewCache(source QuoteSource) *Cache {
+	return &Cache{
+		source:      source,
+		retryPolicy: NoRetries,
+		quotes:      make(map[cacheKey]Quote),
+		inflight:    make(map[cacheKey]*fetchCall),
+	}
+}
+
+// DefaultEndpoints : The quoteservers for the current run environment
+func DefaultEndpoints() []Endpoint {
+	address := getQuoteServAddress()
+	return []Endpoint{{Name: address, Address: address}}
+}
+
+// SetPerUserCaching : When enabled a cached quote is only served to the
+// user it was fetched for, so every user's quotes in the audit trail
+// carry their own username and cryptokey. Off by default, which lets any
+// fresh quote serve any user. Should be called before the first GetQuote.
+func (c *Cache) SetPerUserCaching(enabled bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.perUserCaching = enabled
+}
+
+// SetRetryPolicy : How to retry failed quote server requests.
+// Should be called before the first GetQuote.
+func (c *Cache) SetRetryPolicy(rp RetryPolicy) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.retryPolicy = rp
+}
+
+// SetCircuitBreaker : Guard the quote server with a breaker. nil turns it off.
+// Should be called before the first GetQuote.
+func (c *Cache) SetCircuitBreaker(cb *CircuitBreaker) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.breaker = cb
+}
+
+// SetStaleWindow : While the circuit breaker is open, serve cached quotes
+// that expired no more than window ago, flagged as Stale. Zero turns it off.
+// Should be called before the first GetQuote.
+func (c *Cache) SetStaleWindow(window time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.staleWindow = window
+}
+
+// Subscribe : Calls fn with every quote fetched from the quote server.
+// fn runs on the fetching goroutine before anyone waiting on the quote
+// gets it, so it should hand the quote off rather than do much work.
+func (c *Cache) Subscribe(fn func(Quote)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.subscribers = append(c.subscribers, fn)
 }
 
-//quoteCache holds quotes for each user. e.g "AAPL": {"John": John'sQuoteInstance}
-var quoteCache = make(map[string]map[string]Quote)
+func (c *Cache) keyFor(userID, stock string) cacheKey {
+	if c.perUserCaching {
+		return cacheKey{stock, userID}
+	}
+	return cacheKey{stock, ""}
+}
 
 // GetQuote : Gets the current value of the stock, hitting the local cache if it can.
-func GetQuote(userID, stock string, transactionID int) (Quote, error) {
-	// check if the value is in cache
+func (c *Cache) GetQuote(userID, stock string, transactionID int) (Quote, error) {
+	return c.GetQuoteContext(context.Background(), userID, stock, transactionID)
+}
+
+// LatestQuote : The newest cached quote for the stock fetched for anyone,
+// without asking the quote server. It may have expired.
+func (c *Cache) LatestQuote(stock string) (Quote, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var latest Quote
+	found := false
+	for key, quote := range c.quotes {
+		if key.stock == stock && (!found || quote.Timestamp.After(latest.Timestamp)) {
+			latest, found = quote, true
+		}
+	}
+	return latest, found
+}
+
+// GetQuoteContext : Like GetQuote, but gives up waiting for the quote
+// server when ctx is done. Concurrent misses for the same stock share a
+// single fetch; the fetch carries on for the other waiters if one gives up.
+func (c *Cache) GetQuoteContext(ctx context.Context, userID, stock string, transactionID int) (Quote, error) {
+	return c.GetFreshQuote(ctx, userID, stock, transactionID, expiry.Window())
+}
+
+// GetFreshQuote : Like GetQuoteContext, but cached quotes older than
+// maxAge are fetched again even if they haven't expired.
+func (c *Cache) GetFreshQuote(ctx context.Context, userID, stock string, transactionID int, maxAge time.Duration) (Quote, error) {
+	// check if the value is in cache. Most calls end here so only
+	// take the read lock.
+	c.mutex.RLock()
+	key := c.keyFor(userID, stock)
+	cachedQuote, found := c.quotes[key]
+	c.mutex.RUnlock()
 
-	var userQuote Quote
-	userMap := quoteCache[stock]
-	userQuote, found := userMap[userID]
-	if found && !userQuote.IsExpired() {
+	if found && isFresh(cachedQuote, maxAge) {
 		//Get it from the cache
-		return userQuote, nil
+		return cachedQuote, nil
 	}
-	//Failed to get from cache, go do it outselves.
 
-	// get it from the quote server
-	err := updateQuoteCache(userID, stock)
-	if err != nil {
-		return Quote{}, err
+	//Failed to get from cache, go do it outselves. Join a fetch for the
+	// stock if someone else has already started one.
+	cachedQuote, found, call := c.startOrJoinFetch(key, userID, stock, transactionID, maxAge)
+	if found {
+		// A fetch finished between our cache check and now
+		return cachedQuote, nil
 	}
 
-	// Tag the quote with the transaction that caused the server hit.
-	//
-	// We have to get the new quote, modify it and write it back to the
-	// cache because... go doesn't like accessing properties of indexed
-	// items :p. The alternative is pass the transaction ID all the way
-	// down to parseQuote() but that's way too deep.
-	userQuote = quoteCache[stock][userID]
-	userQuote.TransactionID = transactionID
-	quoteCache[stock][userID] = userQuote
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return Quote{}, ctx.Err()
+	}
 
-	// Write the cache hit to the audit log
-	// FIXME : Should be able to pass Quote to logger.
-	xmlElement := fmt.Sprintf(`
-	<quoteServer>
-		<timestamp>%d</timestamp>
-		<server>QSRV1</server>
-		<transactionNum>%d</transactionNum>
-		<price>%.2f</price>
-		<stockSymbol>%s</stockSymbol>
-		<username>%s</username>
-		<quoteServerTime>%d</quoteServerTime>
-		<cryptokey>%s</cryptokey>
-	</quoteServer>`,
-		time.Now().Unix()*1000, transactionID, userQuote.Price.ToFloat(),
-		userQuote.Stock, userQuote.UserID, userQuote.Timestamp.Unix(),
-		userQuote.Cryptokey,
-	)
+	if call.err == ErrCircuitOpen {
+		// Better an old price than no price
+		if staleQuote, found := c.getStaleQuote(key); found {
+			return staleQuote, nil
+		}
+	}
+	if call.err != nil {
+		return Quote{}, call.err
+	}
 
-	auditlogger.LogQuoteServerHit(xmlElement)
+	// Every waiter was held up by the server hit, so each one gets an
+	// entry tagged with its own user and transaction. It's filed under
+	// the waiter's user so it shows up in their DUMPLOG.
+	userQuote := call.quote
+	userQuote.UserID = userID
+	userQuote.TransactionID = transactionID
+	logQuoteServerHit(userQuote)
 
 	return userQuote, nil
 }
 
-// Refreshes the stock in the global quote cache
-func updateQuoteCache(userID, stock string) error {
-	conn, err := net.DialTimeout("tcp", getQuoteServAddress(), time.Second*10)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	// Send that request!
-	request := fmt.Sprintf("%s,%s\n", stock, userID)
-	conn.Write([]byte(request))
+// startOrJoinFetch : Returns the cached quote if one showed up since the
+// caller last looked. Otherwise returns the fetch to wait on.
+func (c *Cache) startOrJoinFetch(key cacheKey, userID, stock string, transactionID int, maxAge time.Duration) (Quote, bool, *fetchCall) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// listen for response
-	message, err := bufio.NewReader(conn).ReadString('\n')
-	// when stream is done an EOF is omitted that we should ignore
-	if err != nil && err != io.EOF {
-		errMessage := fmt.Sprint("Bufio reader says:", err.Error())
-		return errors.New(errMessage)
+	if cachedQuote, found := c.quotes[key]; found && isFresh(cachedQuote, maxAge) {
+		return cachedQuote, true, nil
 	}
 
-	// Convert the raw response to a Quote
-	quote, err := parseQuote(message)
-	if err != nil {
-		return err
+	call, found := c.inflight[key]
+	if !found {
+		call = &fetchCall{done: make(chan struct{})}
+		c.inflight[key] = call
+		go c.fetch(key, userID, stock, transactionID, call)
 	}
+	call.waiters++
 
-	quoteCache[stock] = map[string]Quote{userID: quote}
+	return Quote{}, false, call
+}
 
-	return nil
+// isFresh : True if the quote hasn't expired and is younger than maxAge
+func isFresh(q Quote, maxAge time.Duration) bool {
+	return !q.IsExpired() && time.Since(q.Timestamp) < maxAge
 }
 
-// Returns the appropriate URL & Port based on the run environment.
-// Conrolled via environment flags
-func getQuoteServAddress() string {
-	var address string
+// fetchCall : A quote server request that one or more callers are waiting on
+type fetchCall struct {
+	done  chan struct{}
+	quote Quote
+	err   error
+	// Callers that started or joined the fetch. Guarded by Cache.mutex.
+	waiters int
+}
 
-	switch os.Getenv("ENV") {
-	case "PROD":
-		address = "quoteserve.seng.uvic.ca:4443"
-	case "DEV":
-	default:
-		address = "localhost:4443"
+// getStaleQuote : The cached quote, if it expired within the stale window
+func (c *Cache) getStaleQuote(key cacheKey) (Quote, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	cachedQuote, found := c.quotes[key]
+	if !found || time.Since(cachedQuote.Timestamp) > expiry.Window()+c.staleWindow {
+		return Quote{}, false
 	}
 
-	return address
+	cachedQuote.Stale = true
+	return cachedQuote, true
 }
 
-func parseQuote(s string) (Quote, error) {
-	// The quoteserver sends back a messy response, with linebreaks.
-	s = strings.TrimSpace(s)
+// fetch : Gets a quote from the source, caches it and wakes the waiters
+func (c *Cache) fetch(key cacheKey, userID, stock string, transactionID int, call *fetchCall) {
+	call.quote, call.err = c.fetchWithRetries(userID, stock, transactionID)
 
-	parts := strings.Split(s, ",")
+	c.mutex.Lock()
+	if call.err == nil {
+		// Tag the quote with the transaction that caused the server hit.
+		call.quote.TransactionID = transactionID
+		c.quotes[key] = call.quote
+	}
+	delete(c.inflight, key)
+	subscribers := c.subscribers
+	c.mutex.Unlock()
 
-	// Does the response have all the parts we need?
-	if len(parts) != 5 {
-		return Quote{}, errors.New("Incorrect number of fields returned by quoteserver")
+	if call.err == nil {
+		for _, fn := range subscribers {
+			fn(call.quote)
+		}
 	}
 
-	balance, err := currency.NewFromString(parts[0])
+	close(call.done)
+}
+
+// fetchWithRetries : Asks the source for a quote until it answers, the
+// retry policy runs out or the circuit breaker stops us.
+func (c *Cache) fetchWithRetries(userID, stock string, transactionID int) (Quote, error) {
+	c.mutex.RLock()
+	retryPolicy, breaker := c.retryPolicy, c.breaker
+	c.mutex.RUnlock()
+
+	var err error
+	for attempt := 0; attempt == 0 || attempt < retryPolicy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			wait := retryPolicy.backoff(attempt - 1)
+			consoleLog.Infof("Retrying quote for %s in %s: %s", stock, wait, err.Error())
+			time.Sleep(wait)
+		}
+
+		if breaker != nil {
+			allowed, changed := breaker.Allow()
+			if changed {
+				logBreakerChange(breaker.State(), userID, stock, transactionID)
+			}
+			if !allowed {
+				return Quote{}, ErrCircuitOpen
+			}
+		}
 
-	if err != nil {
-		return Quote{}, err
+		var quote Quote
+		quote, err = c.source.FetchQuote(userID, stock)
+
+		if breaker != nil && breaker.Record(err) {
+			logBreakerChange(breaker.State(), userID, stock, transactionID)
+		}
+
+		if err == nil {
+			return quote, nil
+		}
 	}
 
-	// Unix time has to be converted string -> int -> Time
-	unixTimeInt, err := strconv.ParseInt(parts[3], 10, 64)
-	if err != nil {
-		return Quote{}, err
+	return Quote{}, err
+}
+
+// logBreakerChange : Records a circuit breaker state change in the audit
+// log against the quote request that caused it.
+func logBreakerChange(state BreakerState, userID, stock string, transactionID int) {
+	consoleLog.Warningf("Quote server circuit breaker is now %s", state)
+
+	cmd := commands.Command{
+		ID:     transactionID,
+		Name:   commands.Quote,
+		UserID: userID,
+		Args:   []string{stock},
 	}
+	auditlogger.LogDebugEvent(cmd, "quote server circuit breaker is now "+state.String())
+}
 
-	quote := Quote{
-		Price:     balance,
-		Stock:     parts[1],
-		UserID:    parts[2],
-		Timestamp: time.Unix(unixTimeInt, 0),
-		Cryptokey: parts[4],
+func logQuoteServerHit(q Quote) {
+	// FIXME : Should be able to pass Quote to logger.
+	xmlElement := fmt.Sprintf(`
+	<quoteServer>
+		<timestamp>%d</timestamp>
+		<server>%s</server>
+		<transactionNum>%d</transactionNum>
+		<price>%.2f</price>
+		<stockSymbol>%s</stockSymbol>
+		<username>%s</username>
+		<quoteServerTime>%d</quoteServerTime>
+		<cryptokey>%s</cryptokey>
+	</quoteServer>`,
+		time.Now().Unix()*1000, q.Server, q.TransactionID, q.Price.ToFloat(),
+		q.Stock, q.UserID, q.Timestamp.Unix(),
+		q.Cryptokey,
+	)
+
+	auditlogger.LogQuoteServerHit(q.UserID, xmlElement)
+}
+
+// Returns the appropriate URL & Port based on the run environment.
+// Conrolled via environment flags
+func getQuoteServAddress() string {
+	var address string
+
+	switch os.Getenv("ENV") {
+	case "PROD":
+		address = "quoteserve.seng.uvic.ca:4443"
+	default:
+		// DEV and anything else runs against a local (mock) quoteserver
+		address = "localhost:4443"
 	}
 
-	return quote, nil
+	return address
 }
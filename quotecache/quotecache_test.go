@@ -0,0 +1,151 @@
+package quotecache
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// countingSource : Counts the fetches that reach the fake source. Each
+// fetch is held until release is closed.
+type countingSource struct {
+	*FakeQuoteSource
+
+	release chan struct{}
+	mutex   sync.Mutex
+	fetches map[string]int
+}
+
+func newCountingSource() *countingSource {
+	return &countingSource{
+		FakeQuoteSource: NewFakeQuoteSource(nil, 1),
+		release:         make(chan struct{}),
+		fetches:         make(map[string]int),
+	}
+}
+
+func (cs *countingSource) FetchQuote(userID, stock string) (Quote, error) {
+	cs.mutex.Lock()
+	cs.fetches[stock]++
+	cs.mutex.Unlock()
+
+	<-cs.release
+	return cs.FakeQuoteSource.FetchQuote(userID, stock)
+}
+
+func (cs *countingSource) count(stock string) int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.fetches[stock]
+}
+
+// waitForCallers : Returns once n callers are waiting on fetches
+func waitForCallers(c *Cache, n int) {
+	for {
+		c.mutex.RLock()
+		waiting := 0
+		for _, call := range c.inflight {
+			waiting += call.waiters
+		}
+		c.mutex.RUnlock()
+
+		if waiting == n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// getQuotes : Asks for each stock from perStock goroutines at once.
+// Every caller is a different user with its own transaction. If fetched,
+// the callers waited on the quote server, so each must get a quote
+// tagged with its own user and transaction. The fetches are only let go
+// once every caller is waiting on one.
+func getQuotes(t *testing.T, c *Cache, source *countingSource, stocks []string, perStock int, fetched bool) map[string][]Quote {
+	var (
+		start  = make(chan struct{})
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		quotes = make(map[string][]Quote)
+	)
+
+	for i := 0; i < perStock*len(stocks); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			userID, stock := fmt.Sprintf("user%d", i), stocks[i%len(stocks)]
+			quote, err := c.GetQuote(userID, stock, i+1)
+			if err != nil {
+				t.Errorf("GetQuote(%s, %s): %s", userID, stock, err.Error())
+				return
+			}
+			if fetched && (quote.UserID != userID || quote.TransactionID != i+1) {
+				t.Errorf("%s asked for %s as transaction %d but got a quote for %s, transaction %d",
+					userID, stock, i+1, quote.UserID, quote.TransactionID)
+			}
+
+			mutex.Lock()
+			quotes[stock] = append(quotes[stock], quote)
+			mutex.Unlock()
+		}(i)
+	}
+
+	close(start)
+	if fetched {
+		waitForCallers(c, perStock*len(stocks))
+		close(source.release)
+	}
+	wg.Wait()
+	return quotes
+}
+
+func TestConcurrentGetQuoteFetchesEachStockOnce(t *testing.T) {
+	source := newCountingSource()
+	cache := NewCache(source)
+	stocks := []string{"ABC", "DEF", "GHI"}
+
+	quotes := getQuotes(t, cache, source, stocks, 20, true)
+
+	for _, stock := range stocks {
+		if n := source.count(stock); n != 1 {
+			t.Errorf("%s was fetched %d times, want 1", stock, n)
+		}
+		if len(quotes[stock]) != 20 {
+			t.Errorf("%s was answered %d times, want 20", stock, len(quotes[stock]))
+		}
+		for _, quote := range quotes[stock] {
+			if quote.Price != quotes[stock][0].Price || quote.Cryptokey != quotes[stock][0].Cryptokey {
+				t.Errorf("%s callers got different quotes from one fetch", stock)
+				break
+			}
+		}
+	}
+
+	// Everyone is served from the cache now
+	getQuotes(t, cache, source, stocks, 5, false)
+	for _, stock := range stocks {
+		if n := source.count(stock); n != 1 {
+			t.Errorf("%s was fetched again after it was cached: %d fetches", stock, n)
+		}
+	}
+}
+
+func TestConcurrentGetQuotePerUserFetchesEachUserOnce(t *testing.T) {
+	source := newCountingSource()
+	cache := NewCache(source)
+	cache.SetPerUserCaching(true)
+	stocks := []string{"ABC", "DEF"}
+
+	// Every caller is a different user, so none of them can share
+	getQuotes(t, cache, source, stocks, 10, true)
+
+	for _, stock := range stocks {
+		if n := source.count(stock); n != 10 {
+			t.Errorf("%s was fetched %d times, want one per user (10)", stock, n)
+		}
+	}
+}
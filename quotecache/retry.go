@@ -0,0 +1,36 @@
+package quotecache
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy : How many times to try the quote server before giving up
+// and how long to wait between tries. The wait doubles after each failure,
+// up to MaxDelay, and is jittered so that retries don't arrive in lockstep.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// NoRetries : Try the quote server once
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// backoff : How long to wait after the given (zero-based) failed attempt.
+// Picks a random duration between half and all of the exponential delay.
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	delay := rp.BaseDelay
+	for i := 0; i < attempt && delay < rp.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rp.MaxDelay {
+		delay = rp.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -0,0 +1,127 @@
+package quotecache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+)
+
+// QuoteSource : Anything that can produce a fresh quote for a stock
+type QuoteSource interface {
+	FetchQuote(userID, stock string) (Quote, error)
+}
+
+// TCPQuoteSource : Gets quotes from a quoteserver using the
+// "stock,user" -> "price,stock,user,time,key" line protocol
+type TCPQuoteSource struct {
+	Address string
+	Timeout time.Duration
+}
+
+// NewTCPQuoteSource : A constructor for a quoteserver client that gives
+// up on a request after timeout
+func NewTCPQuoteSource(address string, timeout time.Duration) *TCPQuoteSource {
+	return &TCPQuoteSource{
+		Address: address,
+		Timeout: timeout,
+	}
+}
+
+// FetchQuote : Asks the quoteserver for the price of stock. The whole
+// request, not just connecting, has to finish within Timeout, so a server
+// that never answers counts as a failure.
+func (ts *TCPQuoteSource) FetchQuote(userID, stock string) (Quote, error) {
+	conn, err := net.DialTimeout("tcp", ts.Address, ts.Timeout)
+	if err != nil {
+		return Quote{}, errors.New("quote server unreachable: " + err.Error())
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(ts.Timeout)); err != nil {
+		return Quote{}, err
+	}
+
+	// Send that request!
+	if _, err := conn.Write([]byte(FormatRequest(userID, stock))); err != nil {
+		return Quote{}, errors.New("quote request failed: " + err.Error())
+	}
+
+	// listen for response
+	message, err := bufio.NewReader(conn).ReadString('\n')
+	// when stream is done an EOF is omitted that we should ignore
+	if err != nil && err != io.EOF {
+		errMessage := fmt.Sprint("Bufio reader says:", err.Error())
+		return Quote{}, errors.New(errMessage)
+	}
+
+	// Convert the raw response to a Quote
+	quote, err := parseQuote(message)
+	if err != nil {
+		return Quote{}, err
+	}
+	quote.Server = ts.Address
+
+	return quote, nil
+}
+
+// FormatRequest : The line a client sends to ask for a quote
+func FormatRequest(userID, stock string) string {
+	return fmt.Sprintf("%s,%s\n", stock, userID)
+}
+
+// ParseRequest : Splits a request line into its user and stock
+func ParseRequest(s string) (userID, stock string, err error) {
+	parts := strings.Split(strings.TrimSpace(s), ",")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.New("Malformed quote request")
+	}
+	return parts[1], parts[0], nil
+}
+
+// FormatResponse : The line a quoteserver sends back for a quote
+func FormatResponse(q Quote) string {
+	return fmt.Sprintf("%.2f,%s,%s,%d,%s\n",
+		q.Price.ToFloat(), q.Stock, q.UserID, q.Timestamp.Unix(), q.Cryptokey,
+	)
+}
+
+func parseQuote(s string) (Quote, error) {
+	// The quoteserver sends back a messy response, with linebreaks.
+	s = strings.TrimSpace(s)
+
+	parts := strings.Split(s, ",")
+
+	// Does the response have all the parts we need?
+	if len(parts) != 5 {
+		return Quote{}, errors.New("Incorrect number of fields returned by quoteserver")
+	}
+
+	balance, err := currency.NewFromString(parts[0])
+
+	if err != nil {
+		return Quote{}, err
+	}
+
+	// Unix time has to be converted string -> int -> Time
+	unixTimeInt, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	quote := Quote{
+		Price:     balance,
+		Stock:     parts[1],
+		UserID:    parts[2],
+		Timestamp: time.Unix(unixTimeInt, 0),
+		Cryptokey: parts[4],
+	}
+
+	return quote, nil
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+)
+
+// userTriggers : stock -> requests, oldest first
+type userTriggers map[string][]autorequests.AutoRequest
+
+// MemoryRepository : An AccountRepository that keeps everything in maps.
+// Transactions run one at a time. Nothing outlives the process, so it's
+// for tests; the app keeps nothing but the stores without -datadir.
+type MemoryRepository struct {
+	accounts        map[string]accounts.Snapshot
+	triggers        [2]map[string]userTriggers
+	ledger          []accounts.LedgerEntry
+	lastTransaction int
+	nextFill        int
+	mutex           sync.Mutex
+}
+
+// NewMemoryRepository : A constructor that returns an empty MemoryRepository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		accounts: make(map[string]accounts.Snapshot),
+		triggers: [2]map[string]userTriggers{
+			make(map[string]userTriggers),
+			make(map[string]userTriggers),
+		},
+	}
+}
+
+// Begin : Starts a transaction. Blocks until the previous one ends.
+func (mr *MemoryRepository) Begin() (Tx, error) {
+	mr.mutex.Lock()
+	return &memoryTx{
+		repo:     mr,
+		accounts: make(map[string]accounts.Snapshot),
+		triggers: [2]map[string]userTriggers{
+			make(map[string]userTriggers),
+			make(map[string]userTriggers),
+		},
+		lastTransaction: mr.lastTransaction,
+		nextFill:        mr.nextFill,
+	}, nil
+}
+
+// Close : Nothing to clean up
+func (mr *MemoryRepository) Close() error {
+	return nil
+}
+
+// memoryTx : Holds writes until Commit copies them into the repository.
+// The repository is locked for as long as the transaction is open.
+type memoryTx struct {
+	repo            *MemoryRepository
+	accounts        map[string]accounts.Snapshot
+	triggers        [2]map[string]userTriggers
+	ledger          []accounts.LedgerEntry
+	lastTransaction int
+	nextFill        int
+	done            bool
+}
+
+func (tx *memoryTx) Users() ([]string, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+
+	seen := make(map[string]bool)
+	for _, accountMap := range []map[string]accounts.Snapshot{tx.repo.accounts, tx.accounts} {
+		for userID := range accountMap {
+			seen[userID] = true
+		}
+	}
+
+	// Staged triggers replace the saved ones, so a user may have lost them all
+	for side := range tx.triggers {
+		for _, triggerMap := range []map[string]userTriggers{tx.repo.triggers[side], tx.triggers[side]} {
+			for userID := range triggerMap {
+				if seen[userID] {
+					continue
+				}
+				requests, _ := tx.Triggers(Side(side), userID)
+				seen[userID] = len(requests) > 0
+			}
+		}
+	}
+
+	users := []string{}
+	for userID, include := range seen {
+		if include {
+			users = append(users, userID)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (tx *memoryTx) Account(userID string) (accounts.Snapshot, bool, error) {
+	if tx.done {
+		return accounts.Snapshot{}, false, errTxDone
+	}
+
+	s, found := tx.accounts[userID]
+	if !found {
+		s, found = tx.repo.accounts[userID]
+	}
+	if !found {
+		return accounts.Snapshot{}, false, nil
+	}
+	return s.Copy(), true, nil
+}
+
+func (tx *memoryTx) PutAccount(userID string, s accounts.Snapshot) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.accounts[userID] = s.Copy()
+	return nil
+}
+
+func (tx *memoryTx) Triggers(side Side, userID string) (map[string][]autorequests.AutoRequest, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+
+	requests, found := tx.triggers[side][userID]
+	if !found {
+		requests = tx.repo.triggers[side][userID]
+	}
+	return copyTriggers(requests), nil
+}
+
+func (tx *memoryTx) PutTriggers(side Side, userID string, requests map[string][]autorequests.AutoRequest) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.triggers[side][userID] = copyTriggers(requests)
+	return nil
+}
+
+func (tx *memoryTx) Ledger() ([]accounts.LedgerEntry, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+
+	entries := append([]accounts.LedgerEntry{}, tx.repo.ledger...)
+	return append(entries, tx.ledger...), nil
+}
+
+func (tx *memoryTx) AppendLedger(entries []accounts.LedgerEntry) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.ledger = append(tx.ledger, entries...)
+	return nil
+}
+
+func (tx *memoryTx) LastTransaction() (int, error) {
+	if tx.done {
+		return 0, errTxDone
+	}
+
+	return tx.lastTransaction, nil
+}
+
+func (tx *memoryTx) SetLastTransaction(txn int) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.lastTransaction = txn
+	return nil
+}
+
+func (tx *memoryTx) NextFill() (int, error) {
+	if tx.done {
+		return 0, errTxDone
+	}
+
+	return tx.nextFill, nil
+}
+
+func (tx *memoryTx) SetNextFill(txn int) error {
+	if tx.done {
+		return errTxDone
+	}
+
+	tx.nextFill = txn
+	return nil
+}
+
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+
+	for userID, s := range tx.accounts {
+		tx.repo.accounts[userID] = s
+	}
+	for side := range tx.triggers {
+		for userID, requests := range tx.triggers[side] {
+			if len(requests) == 0 {
+				delete(tx.repo.triggers[side], userID)
+			} else {
+				tx.repo.triggers[side][userID] = requests
+			}
+		}
+	}
+	tx.repo.ledger = append(tx.repo.ledger, tx.ledger...)
+	tx.repo.lastTransaction = tx.lastTransaction
+	tx.repo.nextFill = tx.nextFill
+
+	return tx.end()
+}
+
+func (tx *memoryTx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+
+	return tx.end()
+}
+
+func (tx *memoryTx) end() error {
+	tx.done = true
+	tx.repo.mutex.Unlock()
+	return nil
+}
+
+func copyTriggers(requests map[string][]autorequests.AutoRequest) map[string][]autorequests.AutoRequest {
+	copied := make(map[string][]autorequests.AutoRequest, len(requests))
+	for stock, stockRequests := range requests {
+		copied[stock] = append([]autorequests.AutoRequest(nil), stockRequests...)
+	}
+	return copied
+}
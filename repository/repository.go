@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+)
+
+// Side : Which side of the market a trigger or pending action is on
+type Side int
+
+// Side enum!
+const (
+	Buys Side = iota
+	Sells
+)
+
+var sideNames = []string{
+	"buy",
+	"sell",
+}
+
+// String representation of the Side enum
+func (s Side) String() string {
+	return sideNames[s]
+}
+
+var errTxDone = errors.New("Transaction has already been committed or rolled back")
+
+// AccountRepository : Where accounts, portfolios, pending actions and
+// triggers are kept between commands. All reads and writes go through
+// a Tx. SQLRepository and persist.Journal keep them on disk.
+type AccountRepository interface {
+	// Begin : Starts a transaction. Every transaction must end with
+	// Commit or Rollback.
+	Begin() (Tx, error)
+	Close() error
+}
+
+// Tx : A set of reads and writes that are saved together by Commit or
+// not at all. Writes are visible to reads in the same Tx straight away.
+type Tx interface {
+	// Users : Everyone with an account or a trigger, sorted
+	Users() ([]string, error)
+
+	// Account : The user's account. False if they don't have one.
+	Account(userID string) (accounts.Snapshot, bool, error)
+	// PutAccount : Creates or replaces the user's account, including its
+	// portfolio, pending actions and reservations
+	PutAccount(userID string, s accounts.Snapshot) error
+
+	// Triggers : The user's triggers on one side, keyed by stock
+	Triggers(side Side, userID string) (map[string][]autorequests.AutoRequest, error)
+	// PutTriggers : Replaces all of the user's triggers on one side
+	PutTriggers(side Side, userID string, requests map[string][]autorequests.AutoRequest) error
+
+	// Ledger : Every ledger entry, oldest first
+	Ledger() ([]accounts.LedgerEntry, error)
+	// AppendLedger : Adds entries to the end of the ledger
+	AppendLedger(entries []accounts.LedgerEntry) error
+
+	// LastTransaction : The newest transaction number saved. 0 if none.
+	LastTransaction() (int, error)
+	SetLastTransaction(txn int) error
+
+	// NextFill : The transaction number the next trigger fill takes.
+	// 0 if none saved.
+	NextFill() (int, error)
+	SetNextFill(txn int) error
+
+	Commit() error
+	Rollback() error
+}
+
+// Load : Fills the empty stores with everything in the repository.
+// Returns the newest transaction number saved and the number the next
+// trigger fill takes, 0 if there's none saved.
+func Load(
+	repo AccountRepository, as *accounts.AccountStore,
+	autoBuys, autoSells *autorequests.AutoRequestStore,
+) (lastTransaction, nextFill int, err error) {
+	tx, err := repo.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	// Nothing is written so there's nothing to commit
+	defer tx.Rollback()
+
+	users, err := tx.Users()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, userID := range users {
+		s, found, err := tx.Account(userID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if found {
+			as.RestoreAccount(userID, s)
+		}
+
+		buys, err := tx.Triggers(Buys, userID)
+		if err != nil {
+			return 0, 0, err
+		}
+		autoBuys.SetUserAutorequests(userID, buys)
+
+		sells, err := tx.Triggers(Sells, userID)
+		if err != nil {
+			return 0, 0, err
+		}
+		autoSells.SetUserAutorequests(userID, sells)
+	}
+
+	entries, err := tx.Ledger()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		as.Ledger.Append(entry)
+	}
+
+	if lastTransaction, err = tx.LastTransaction(); err != nil {
+		return 0, 0, err
+	}
+	if nextFill, err = tx.NextFill(); err != nil {
+		return 0, 0, err
+	}
+	return lastTransaction, nextFill, nil
+}
+
+// Save : Writes the current state of userIDs and the new ledger entries
+// to the repository in one transaction, as of transaction txn. nextFill
+// is the number the next trigger fill will take.
+func Save(
+	repo AccountRepository, txn, nextFill int, as *accounts.AccountStore,
+	autoBuys, autoSells *autorequests.AutoRequestStore,
+	userIDs []string, newEntries []accounts.LedgerEntry,
+) error {
+	tx, err := repo.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := saveUsers(tx, as, autoBuys, autoSells, userIDs); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.AppendLedger(newEntries); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.SetLastTransaction(txn); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.SetNextFill(nextFill); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func saveUsers(
+	tx Tx, as *accounts.AccountStore,
+	autoBuys, autoSells *autorequests.AutoRequestStore,
+	userIDs []string,
+) error {
+	for _, userID := range userIDs {
+		if account := as.GetAccount(userID); account != nil {
+			if err := tx.PutAccount(userID, account.Snapshot()); err != nil {
+				return err
+			}
+		}
+		if err := tx.PutTriggers(Buys, userID, autoBuys.GetUserAutorequests(userID)); err != nil {
+			return err
+		}
+		if err := tx.PutTriggers(Sells, userID, autoSells.GetUserAutorequests(userID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,500 @@
+package repository_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/persist"
+	"github.com/distributeddesigns/milestone1/repository"
+)
+
+// implementation : An AccountRepository to run the contract against.
+// open is called again on the same dir to check what a durable
+// repository kept after Close.
+type implementation struct {
+	name    string
+	open    func(t *testing.T, dir string) repository.AccountRepository
+	durable bool
+}
+
+var implementations = []implementation{
+	{
+		name: "memory",
+		open: func(t *testing.T, dir string) repository.AccountRepository {
+			return repository.NewMemoryRepository()
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, dir string) repository.AccountRepository {
+			repo, err := repository.OpenSQLite(filepath.Join(dir, "accounts.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		},
+		durable: true,
+	},
+	{
+		name:    "journal",
+		open:    openJournal(0),
+		durable: true,
+	},
+	{
+		// Snapshots after every transaction, so everything is read back
+		// from the snapshot and ledger files rather than the log
+		name:    "journal snapshots",
+		open:    openJournal(1),
+		durable: true,
+	},
+}
+
+func openJournal(snapshotEvery int) func(t *testing.T, dir string) repository.AccountRepository {
+	return func(t *testing.T, dir string) repository.AccountRepository {
+		j, err := persist.Open(dir, persist.Options{Sync: persist.SyncNever, SnapshotEvery: snapshotEvery})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+}
+
+// forEach : Runs the test against a new, empty repository of each kind.
+// reopen closes the repository and opens it again, to check what a
+// durable one kept.
+func forEach(t *testing.T, test func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository)) {
+	for _, impl := range implementations {
+		impl := impl
+		t.Run(impl.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "repository")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			repo := impl.open(t, dir)
+			defer func() { repo.Close() }()
+
+			reopen := func() repository.AccountRepository {
+				if err := repo.Close(); err != nil {
+					t.Fatal(err)
+				}
+				repo = impl.open(t, dir)
+				return repo
+			}
+
+			test(t, impl, repo, reopen)
+		})
+	}
+}
+
+func begin(t *testing.T, repo repository.AccountRepository) repository.Tx {
+	tx, err := repo.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func commit(t *testing.T, tx repository.Tx) {
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var (
+	monday  = time.Date(2017, time.March, 6, 9, 30, 0, 0, time.UTC)
+	tuesday = time.Date(2017, time.March, 7, 14, 5, 30, 250000000, time.UTC)
+)
+
+// sampleAccount : An account with something in every field
+func sampleAccount(t *testing.T) accounts.Snapshot {
+	return accounts.Snapshot{
+		Balance: testutil.Money(t, "1234.56"),
+		BuyQueue: accounts.ActionQueue{
+			{Time: monday, Stock: "ABC", Units: 10, UnitPrice: testutil.Money(t, "12.34"), ReservationID: 2},
+		},
+		SellQueue: accounts.ActionQueue{
+			{Time: tuesday, Stock: "DEF", Units: 3, UnitPrice: testutil.Money(t, "5.00")},
+			{Time: monday, Stock: "DEF", Units: 1, UnitPrice: testutil.Money(t, "5.01")},
+		},
+		Portfolio: accounts.Portfolio{"DEF": 6, "GHI": 1},
+		Lots: map[string][]accounts.Lot{
+			"DEF": {
+				{Units: 4, UnitPrice: testutil.Money(t, "4.50"), Time: monday},
+				{Units: 6, UnitPrice: testutil.Money(t, "5.25"), Time: tuesday},
+			},
+			"GHI": {{Units: 1, UnitPrice: testutil.Money(t, "99.99"), Time: tuesday}},
+		},
+		Realized: map[string]accounts.ProfitLoss{
+			"DEF": {Gain: testutil.Money(t, "2.00")},
+			"XYZ": {Loss: testutil.Money(t, "7.50")},
+		},
+		Reservations: []accounts.Reservation{
+			{ID: 1, Amount: testutil.Money(t, "100.00"), Owner: "SET_BUY_AMOUNT ABC"},
+			{ID: 2, Amount: testutil.Money(t, "123.40"), Owner: "BUY ABC"},
+		},
+		LastReservationID: 2,
+	}
+}
+
+func sampleTriggers(t *testing.T) map[string][]autorequests.AutoRequest {
+	return map[string][]autorequests.AutoRequest{
+		"ABC": {
+			{ID: 3, State: autorequests.Armed, Amount: testutil.Money(t, "100.00"), Trigger: testutil.Money(t, "9.50"), ReservationID: 1},
+			{ID: 7, State: autorequests.AmountSet, Amount: testutil.Money(t, "50.00")},
+		},
+		"DEF": {
+			{ID: 5, State: autorequests.Armed, Amount: testutil.Money(t, "20.00"), Trigger: testutil.Money(t, "6.00"), Units: 3},
+		},
+	}
+}
+
+func sampleLedger(t *testing.T) []accounts.LedgerEntry {
+	return []accounts.LedgerEntry{
+		{Time: monday, UserID: "alice", TransactionNum: 1, Command: commands.Add, Kind: accounts.Credit,
+			Amount: testutil.Money(t, "2000.00"), Balance: testutil.Money(t, "2000.00")},
+		{Time: monday, UserID: "alice", TransactionNum: 4, Command: commands.CommitBuy, Kind: accounts.Debit,
+			Amount: testutil.Money(t, "45.00"), Balance: testutil.Money(t, "1955.00")},
+		{Time: tuesday, UserID: "alice", TransactionNum: 4, Command: commands.CommitBuy, Kind: accounts.ShareGrant,
+			Stock: "DEF", Units: 10, Balance: testutil.Money(t, "1955.00"), Holding: 10},
+	}
+}
+
+// state : Everything a repository holds, read in one transaction
+type state struct {
+	users           []string
+	accounts        map[string]accounts.Snapshot
+	buys            map[string]map[string][]autorequests.AutoRequest
+	sells           map[string]map[string][]autorequests.AutoRequest
+	ledger          []accounts.LedgerEntry
+	lastTransaction int
+	nextFill        int
+}
+
+func readState(t *testing.T, tx repository.Tx) state {
+	s := state{
+		accounts: make(map[string]accounts.Snapshot),
+		buys:     make(map[string]map[string][]autorequests.AutoRequest),
+		sells:    make(map[string]map[string][]autorequests.AutoRequest),
+	}
+
+	var err error
+	if s.users, err = tx.Users(); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range s.users {
+		account, found, err := tx.Account(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			// Copies make empty and nil collections the same
+			s.accounts[userID] = account.Copy()
+		}
+		if s.buys[userID], err = tx.Triggers(repository.Buys, userID); err != nil {
+			t.Fatal(err)
+		}
+		if s.sells[userID], err = tx.Triggers(repository.Sells, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.ledger, err = tx.Ledger(); err != nil {
+		t.Fatal(err)
+	}
+	if s.lastTransaction, err = tx.LastTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if s.nextFill, err = tx.NextFill(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func readCommitted(t *testing.T, repo repository.AccountRepository) state {
+	tx := begin(t, repo)
+	defer tx.Rollback()
+	return readState(t, tx)
+}
+
+func checkState(t *testing.T, when string, got, want state) {
+	if !reflect.DeepEqual(got.users, want.users) {
+		t.Errorf("%s: users are %v, want %v", when, got.users, want.users)
+	}
+	if !reflect.DeepEqual(got.accounts, want.accounts) {
+		t.Errorf("%s: accounts are\n%+v\nwant\n%+v", when, got.accounts, want.accounts)
+	}
+	if !reflect.DeepEqual(got.buys, want.buys) {
+		t.Errorf("%s: buy triggers are %+v, want %+v", when, got.buys, want.buys)
+	}
+	if !reflect.DeepEqual(got.sells, want.sells) {
+		t.Errorf("%s: sell triggers are %+v, want %+v", when, got.sells, want.sells)
+	}
+	if len(got.ledger) != len(want.ledger) || (len(want.ledger) > 0 && !reflect.DeepEqual(got.ledger, want.ledger)) {
+		t.Errorf("%s: ledger is %+v, want %+v", when, got.ledger, want.ledger)
+	}
+	if got.lastTransaction != want.lastTransaction {
+		t.Errorf("%s: last transaction is %d, want %d", when, got.lastTransaction, want.lastTransaction)
+	}
+	if got.nextFill != want.nextFill {
+		t.Errorf("%s: next fill is %d, want %d", when, got.nextFill, want.nextFill)
+	}
+}
+
+func emptyState() state {
+	return state{
+		users:    []string{},
+		accounts: map[string]accounts.Snapshot{},
+		buys:     map[string]map[string][]autorequests.AutoRequest{},
+		sells:    map[string]map[string][]autorequests.AutoRequest{},
+	}
+}
+
+func TestEmptyRepository(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		tx := begin(t, repo)
+		defer tx.Rollback()
+
+		checkState(t, "new repository", readState(t, tx), emptyState())
+
+		if _, found, err := tx.Account("nobody"); found || err != nil {
+			t.Errorf("Account(nobody) = found %t, err %v; want not found", found, err)
+		}
+	})
+}
+
+func TestCommitKeepsEverything(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		alice := sampleAccount(t)
+		triggers := sampleTriggers(t)
+
+		want := emptyState()
+		want.users = []string{"alice", "bob"}
+		want.accounts["alice"] = alice.Copy()
+		want.buys["alice"] = triggers
+		want.sells["alice"] = map[string][]autorequests.AutoRequest{}
+		// bob has triggers but no account
+		want.buys["bob"] = map[string][]autorequests.AutoRequest{}
+		want.sells["bob"] = map[string][]autorequests.AutoRequest{"DEF": triggers["DEF"]}
+		want.ledger = sampleLedger(t)
+		want.lastTransaction = 4
+		want.nextFill = 1000000003
+
+		tx := begin(t, repo)
+		if err := tx.PutAccount("alice", alice); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.PutTriggers(repository.Buys, "alice", triggers); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.PutTriggers(repository.Sells, "bob", want.sells["bob"]); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AppendLedger(want.ledger); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SetLastTransaction(4); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SetNextFill(1000000003); err != nil {
+			t.Fatal(err)
+		}
+
+		checkState(t, "before commit", readState(t, tx), want)
+		commit(t, tx)
+		checkState(t, "after commit", readCommitted(t, repo), want)
+
+		if impl.durable {
+			repo = reopen()
+			checkState(t, "after reopening", readCommitted(t, repo), want)
+		}
+	})
+}
+
+func TestRollbackKeepsNothing(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		tx := begin(t, repo)
+		if err := tx.PutAccount("alice", sampleAccount(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.PutTriggers(repository.Sells, "alice", sampleTriggers(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AppendLedger(sampleLedger(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SetLastTransaction(9); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SetNextFill(1000000001); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		checkState(t, "after rollback", readCommitted(t, repo), emptyState())
+
+		if impl.durable {
+			repo = reopen()
+			checkState(t, "after reopening", readCommitted(t, repo), emptyState())
+		}
+	})
+}
+
+func TestPutsReplace(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		tx := begin(t, repo)
+		if err := tx.PutAccount("alice", sampleAccount(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.PutTriggers(repository.Buys, "bob", sampleTriggers(t)); err != nil {
+			t.Fatal(err)
+		}
+		commit(t, tx)
+
+		// A smaller account replaces the whole of the old one, and bob
+		// goes away with his last trigger
+		smaller := accounts.Snapshot{
+			Balance:   testutil.Money(t, "10.00"),
+			Portfolio: accounts.Portfolio{"ABC": 1},
+		}
+		tx = begin(t, repo)
+		if err := tx.PutAccount("alice", smaller); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.PutTriggers(repository.Buys, "bob", map[string][]autorequests.AutoRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		commit(t, tx)
+
+		want := emptyState()
+		want.users = []string{"alice"}
+		want.accounts["alice"] = smaller.Copy()
+		want.buys["alice"] = map[string][]autorequests.AutoRequest{}
+		want.sells["alice"] = map[string][]autorequests.AutoRequest{}
+
+		checkState(t, "after replacing", readCommitted(t, repo), want)
+
+		if impl.durable {
+			repo = reopen()
+			checkState(t, "after reopening", readCommitted(t, repo), want)
+		}
+	})
+}
+
+func TestLedgerOnlyGrows(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		ledger := sampleLedger(t)
+
+		for i, entry := range ledger {
+			tx := begin(t, repo)
+			if err := tx.AppendLedger([]accounts.LedgerEntry{entry}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.SetLastTransaction(entry.TransactionNum); err != nil {
+				t.Fatal(err)
+			}
+			commit(t, tx)
+
+			got := readCommitted(t, repo)
+			if !reflect.DeepEqual(got.ledger, ledger[:i+1]) {
+				t.Fatalf("after %d appends the ledger is %+v, want %+v", i+1, got.ledger, ledger[:i+1])
+			}
+		}
+
+		if impl.durable {
+			repo = reopen()
+			if got := readCommitted(t, repo); !reflect.DeepEqual(got.ledger, ledger) {
+				t.Errorf("after reopening the ledger is %+v, want %+v", got.ledger, ledger)
+			}
+		}
+	})
+}
+
+func TestFinishedTransactionsFail(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		tx := begin(t, repo)
+		commit(t, tx)
+
+		if err := tx.PutAccount("alice", sampleAccount(t)); err == nil {
+			t.Error("PutAccount after Commit succeeded")
+		}
+		if err := tx.Commit(); err == nil {
+			t.Error("second Commit succeeded")
+		}
+		if err := tx.Rollback(); err == nil {
+			t.Error("Rollback after Commit succeeded")
+		}
+
+		// The repository can still be used
+		tx = begin(t, repo)
+		tx.Rollback()
+	})
+}
+
+func TestSaveThenLoad(t *testing.T) {
+	forEach(t, func(t *testing.T, impl implementation, repo repository.AccountRepository, reopen func() repository.AccountRepository) {
+		saved := accounts.NewAccountStore()
+		savedBuys := autorequests.NewAutoRequestStore()
+		savedSells := autorequests.NewAutoRequestStore()
+
+		saved.RestoreAccount("alice", sampleAccount(t))
+		savedBuys.SetUserAutorequests("alice", sampleTriggers(t))
+		savedSells.SetUserAutorequests("bob", sampleTriggers(t))
+		for _, entry := range sampleLedger(t) {
+			saved.Ledger.Append(entry)
+		}
+
+		err := repository.Save(
+			repo, 4, 1000000002, saved, savedBuys, savedSells,
+			[]string{"alice", "bob"}, saved.Ledger.Since(0),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if impl.durable {
+			repo = reopen()
+		}
+
+		loaded := accounts.NewAccountStore()
+		loadedBuys := autorequests.NewAutoRequestStore()
+		loadedSells := autorequests.NewAutoRequestStore()
+		lastTransaction, nextFill, err := repository.Load(repo, loaded, loadedBuys, loadedSells)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lastTransaction != 4 {
+			t.Errorf("Load returned transaction %d, want 4", lastTransaction)
+		}
+		if nextFill != 1000000002 {
+			t.Errorf("Load returned next fill %d, want 1000000002", nextFill)
+		}
+		if got := loaded.Names(); !reflect.DeepEqual(got, []string{"alice"}) {
+			t.Errorf("loaded accounts for %v, want [alice]", got)
+		} else if got, want := loaded.GetAccount("alice").Snapshot(), saved.GetAccount("alice").Snapshot(); !reflect.DeepEqual(got, want) {
+			t.Errorf("loaded account\n%+v\nwant\n%+v", got, want)
+		}
+		for _, userID := range []string{"alice", "bob"} {
+			if got, want := loadedBuys.GetUserAutorequests(userID), savedBuys.GetUserAutorequests(userID); !reflect.DeepEqual(got, want) {
+				t.Errorf("loaded buy triggers for %s %+v, want %+v", userID, got, want)
+			}
+			if got, want := loadedSells.GetUserAutorequests(userID), savedSells.GetUserAutorequests(userID); !reflect.DeepEqual(got, want) {
+				t.Errorf("loaded sell triggers for %s %+v, want %+v", userID, got, want)
+			}
+		}
+		if got, want := loaded.Ledger.Since(0), saved.Ledger.Since(0); !reflect.DeepEqual(got, want) {
+			t.Errorf("loaded ledger %+v, want %+v", got, want)
+		}
+	})
+}
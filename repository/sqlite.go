@@ -0,0 +1,539 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	// Registers the "sqlite3" driver
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+)
+
+// Money is stored as "12.34" so it reads back exactly. Times are stored
+// as RFC 3339 strings.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS accounts (
+		user_id             TEXT PRIMARY KEY,
+		balance             TEXT NOT NULL,
+		last_reservation_id INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS portfolios (
+		user_id TEXT NOT NULL,
+		stock   TEXT NOT NULL,
+		units   INTEGER NOT NULL,
+		PRIMARY KEY (user_id, stock)
+	)`,
+	`CREATE TABLE IF NOT EXISTS lots (
+		user_id    TEXT NOT NULL,
+		stock      TEXT NOT NULL,
+		position   INTEGER NOT NULL,
+		units      INTEGER NOT NULL,
+		unit_price TEXT NOT NULL,
+		created    TEXT NOT NULL,
+		PRIMARY KEY (user_id, stock, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS realized (
+		user_id TEXT NOT NULL,
+		stock   TEXT NOT NULL,
+		gain    TEXT NOT NULL,
+		loss    TEXT NOT NULL,
+		PRIMARY KEY (user_id, stock)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pending_actions (
+		user_id        TEXT NOT NULL,
+		side           INTEGER NOT NULL,
+		position       INTEGER NOT NULL,
+		created        TEXT NOT NULL,
+		stock          TEXT NOT NULL,
+		units          INTEGER NOT NULL,
+		unit_price     TEXT NOT NULL,
+		reservation_id INTEGER NOT NULL,
+		PRIMARY KEY (user_id, side, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS reservations (
+		user_id TEXT NOT NULL,
+		id      INTEGER NOT NULL,
+		amount  TEXT NOT NULL,
+		owner   TEXT NOT NULL,
+		PRIMARY KEY (user_id, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS triggers (
+		side           INTEGER NOT NULL,
+		user_id        TEXT NOT NULL,
+		stock          TEXT NOT NULL,
+		id             INTEGER NOT NULL,
+		state          INTEGER NOT NULL,
+		amount         TEXT NOT NULL,
+		trigger_price  TEXT NOT NULL,
+		reservation_id INTEGER NOT NULL,
+		units          INTEGER NOT NULL,
+		PRIMARY KEY (side, user_id, stock, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ledger (
+		seq             INTEGER PRIMARY KEY AUTOINCREMENT,
+		created         TEXT NOT NULL,
+		user_id         TEXT NOT NULL,
+		transaction_num INTEGER NOT NULL,
+		command         TEXT NOT NULL,
+		kind            INTEGER NOT NULL,
+		amount          TEXT NOT NULL,
+		stock           TEXT NOT NULL,
+		units           INTEGER NOT NULL,
+		balance         TEXT NOT NULL,
+		holding         INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	)`,
+}
+
+// SQLRepository : An AccountRepository backed by an SQLite database file
+type SQLRepository struct {
+	db *sql.DB
+}
+
+// OpenSQLite : Opens, or creates, the database at path
+func OpenSQLite(path string) (*SQLRepository, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer. Sharing a single connection keeps
+	// transactions from failing with "database is locked".
+	db.SetMaxOpenConns(1)
+
+	for _, statement := range schema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &SQLRepository{db}, nil
+}
+
+// Begin : Starts a database transaction
+func (sr *SQLRepository) Begin() (Tx, error) {
+	tx, err := sr.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx}, nil
+}
+
+// Close : Closes the database
+func (sr *SQLRepository) Close() error {
+	return sr.db.Close()
+}
+
+type sqlTx struct {
+	tx *sql.Tx
+}
+
+func (st *sqlTx) Users() ([]string, error) {
+	rows, err := st.tx.Query(`
+		SELECT user_id FROM accounts
+		UNION
+		SELECT user_id FROM triggers
+		ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+func (st *sqlTx) Account(userID string) (accounts.Snapshot, bool, error) {
+	var balance string
+	var lastReservationID uint64
+	err := st.tx.QueryRow(
+		`SELECT balance, last_reservation_id FROM accounts WHERE user_id = ?`, userID,
+	).Scan(&balance, &lastReservationID)
+	if err == sql.ErrNoRows {
+		return accounts.Snapshot{}, false, nil
+	} else if err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+
+	s := accounts.Snapshot{
+		Portfolio:         make(accounts.Portfolio),
+		Lots:              make(map[string][]accounts.Lot),
+		Realized:          make(map[string]accounts.ProfitLoss),
+		BuyQueue:          accounts.ActionQueue{},
+		SellQueue:         accounts.ActionQueue{},
+		Reservations:      []accounts.Reservation{},
+		LastReservationID: accounts.ReservationID(lastReservationID),
+	}
+	if s.Balance, err = accounts.ParseMoney(balance); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	if err := st.readPortfolio(userID, s.Portfolio); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	if err := st.readLots(userID, s.Lots); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	if err := st.readRealized(userID, s.Realized); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	if s.BuyQueue, err = st.readActions(userID, Buys); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	if s.SellQueue, err = st.readActions(userID, Sells); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+	if s.Reservations, err = st.readReservations(userID); err != nil {
+		return accounts.Snapshot{}, false, err
+	}
+
+	return s, true, nil
+}
+
+func (st *sqlTx) readPortfolio(userID string, p accounts.Portfolio) error {
+	rows, err := st.tx.Query(`SELECT stock, units FROM portfolios WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stock string
+		var units accounts.Shares
+		if err := rows.Scan(&stock, &units); err != nil {
+			return err
+		}
+		p[stock] = units
+	}
+	return rows.Err()
+}
+
+func (st *sqlTx) readLots(userID string, lots map[string][]accounts.Lot) error {
+	rows, err := st.tx.Query(`
+		SELECT stock, units, unit_price, created FROM lots
+		WHERE user_id = ?
+		ORDER BY stock, position`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stock, unitPrice, created string
+		var lot accounts.Lot
+		if err := rows.Scan(&stock, &lot.Units, &unitPrice, &created); err != nil {
+			return err
+		}
+		if lot.UnitPrice, err = accounts.ParseMoney(unitPrice); err != nil {
+			return err
+		}
+		if lot.Time, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return err
+		}
+		lots[stock] = append(lots[stock], lot)
+	}
+	return rows.Err()
+}
+
+func (st *sqlTx) readRealized(userID string, realized map[string]accounts.ProfitLoss) error {
+	rows, err := st.tx.Query(`SELECT stock, gain, loss FROM realized WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stock, gain, loss string
+		var pl accounts.ProfitLoss
+		if err := rows.Scan(&stock, &gain, &loss); err != nil {
+			return err
+		}
+		if pl.Gain, err = accounts.ParseMoney(gain); err != nil {
+			return err
+		}
+		if pl.Loss, err = accounts.ParseMoney(loss); err != nil {
+			return err
+		}
+		realized[stock] = pl
+	}
+	return rows.Err()
+}
+
+func (st *sqlTx) readActions(userID string, side Side) (accounts.ActionQueue, error) {
+	rows, err := st.tx.Query(`
+		SELECT created, stock, units, unit_price, reservation_id
+		FROM pending_actions
+		WHERE user_id = ? AND side = ?
+		ORDER BY position`, userID, side)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := accounts.ActionQueue{}
+	for rows.Next() {
+		var act accounts.Action
+		var created, unitPrice string
+		if err := rows.Scan(&created, &act.Stock, &act.Units, &unitPrice, &act.ReservationID); err != nil {
+			return nil, err
+		}
+		if act.Time, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, err
+		}
+		if act.UnitPrice, err = accounts.ParseMoney(unitPrice); err != nil {
+			return nil, err
+		}
+		queue = append(queue, act)
+	}
+	return queue, rows.Err()
+}
+
+func (st *sqlTx) readReservations(userID string) ([]accounts.Reservation, error) {
+	rows, err := st.tx.Query(`
+		SELECT id, amount, owner FROM reservations
+		WHERE user_id = ?
+		ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []accounts.Reservation{}
+	for rows.Next() {
+		var r accounts.Reservation
+		var amount string
+		if err := rows.Scan(&r.ID, &amount, &r.Owner); err != nil {
+			return nil, err
+		}
+		if r.Amount, err = accounts.ParseMoney(amount); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+func (st *sqlTx) PutAccount(userID string, s accounts.Snapshot) error {
+	_, err := st.tx.Exec(`
+		INSERT OR REPLACE INTO accounts (user_id, balance, last_reservation_id)
+		VALUES (?, ?, ?)`, userID, accounts.FormatMoney(s.Balance), uint64(s.LastReservationID))
+	if err != nil {
+		return err
+	}
+
+	// Replace the rest of the account wholesale
+	for _, table := range []string{"portfolios", "lots", "realized", "pending_actions", "reservations"} {
+		if _, err := st.tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, userID); err != nil {
+			return err
+		}
+	}
+
+	for stock, units := range s.Portfolio {
+		if _, err := st.tx.Exec(`
+			INSERT INTO portfolios (user_id, stock, units)
+			VALUES (?, ?, ?)`, userID, stock, units); err != nil {
+			return err
+		}
+	}
+
+	for stock, lots := range s.Lots {
+		for position, lot := range lots {
+			if _, err := st.tx.Exec(`
+				INSERT INTO lots (user_id, stock, position, units, unit_price, created)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				userID, stock, position, lot.Units, accounts.FormatMoney(lot.UnitPrice),
+				lot.Time.Format(time.RFC3339Nano),
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	for stock, pl := range s.Realized {
+		if _, err := st.tx.Exec(`
+			INSERT INTO realized (user_id, stock, gain, loss)
+			VALUES (?, ?, ?, ?)`, userID, stock, accounts.FormatMoney(pl.Gain), accounts.FormatMoney(pl.Loss)); err != nil {
+			return err
+		}
+	}
+
+	for side, queue := range []accounts.ActionQueue{Buys: s.BuyQueue, Sells: s.SellQueue} {
+		for position, act := range queue {
+			if _, err := st.tx.Exec(`
+				INSERT INTO pending_actions
+					(user_id, side, position, created, stock, units, unit_price, reservation_id)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				userID, side, position, act.Time.Format(time.RFC3339Nano),
+				act.Stock, act.Units, accounts.FormatMoney(act.UnitPrice), uint64(act.ReservationID),
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range s.Reservations {
+		if _, err := st.tx.Exec(`
+			INSERT INTO reservations (user_id, id, amount, owner)
+			VALUES (?, ?, ?, ?)`, userID, uint64(r.ID), accounts.FormatMoney(r.Amount), r.Owner); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (st *sqlTx) Triggers(side Side, userID string) (map[string][]autorequests.AutoRequest, error) {
+	rows, err := st.tx.Query(`
+		SELECT stock, id, state, amount, trigger_price, reservation_id, units FROM triggers
+		WHERE side = ? AND user_id = ? ORDER BY stock, id`, side, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make(map[string][]autorequests.AutoRequest)
+	for rows.Next() {
+		var stock, amount, trigger string
+		var request autorequests.AutoRequest
+		if err := rows.Scan(&stock, &request.ID, &request.State, &amount, &trigger, &request.ReservationID, &request.Units); err != nil {
+			return nil, err
+		}
+		if request.Amount, err = accounts.ParseMoney(amount); err != nil {
+			return nil, err
+		}
+		if request.Trigger, err = accounts.ParseMoney(trigger); err != nil {
+			return nil, err
+		}
+		requests[stock] = append(requests[stock], request)
+	}
+	return requests, rows.Err()
+}
+
+func (st *sqlTx) PutTriggers(side Side, userID string, requests map[string][]autorequests.AutoRequest) error {
+	if _, err := st.tx.Exec(`DELETE FROM triggers WHERE side = ? AND user_id = ?`, side, userID); err != nil {
+		return err
+	}
+
+	for stock, stockRequests := range requests {
+		for _, request := range stockRequests {
+			if _, err := st.tx.Exec(`
+				INSERT INTO triggers (side, user_id, stock, id, state, amount, trigger_price, reservation_id, units)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				side, userID, stock, request.ID, int(request.State), accounts.FormatMoney(request.Amount), accounts.FormatMoney(request.Trigger),
+				uint64(request.ReservationID), request.Units,
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (st *sqlTx) Ledger() ([]accounts.LedgerEntry, error) {
+	rows, err := st.tx.Query(`
+		SELECT created, user_id, transaction_num, command, kind,
+			amount, stock, units, balance, holding
+		FROM ledger
+		ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []accounts.LedgerEntry{}
+	for rows.Next() {
+		var e accounts.LedgerEntry
+		var created, command, amount, balance string
+		if err := rows.Scan(
+			&created, &e.UserID, &e.TransactionNum, &command, &e.Kind,
+			&amount, &e.Stock, &e.Units, &balance, &e.Holding,
+		); err != nil {
+			return nil, err
+		}
+		if e.Time, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, err
+		}
+		if e.Command, err = commands.ToCommandType(command); err != nil {
+			return nil, err
+		}
+		if e.Amount, err = accounts.ParseMoney(amount); err != nil {
+			return nil, err
+		}
+		if e.Balance, err = accounts.ParseMoney(balance); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (st *sqlTx) AppendLedger(entries []accounts.LedgerEntry) error {
+	for _, e := range entries {
+		if _, err := st.tx.Exec(`
+			INSERT INTO ledger
+				(created, user_id, transaction_num, command, kind,
+				amount, stock, units, balance, holding)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Time.Format(time.RFC3339Nano), e.UserID, e.TransactionNum, e.Command.String(), int(e.Kind),
+			accounts.FormatMoney(e.Amount), e.Stock, e.Units, accounts.FormatMoney(e.Balance), e.Holding,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *sqlTx) LastTransaction() (int, error) {
+	return st.meta("last_transaction")
+}
+
+func (st *sqlTx) SetLastTransaction(txn int) error {
+	return st.setMeta("last_transaction", txn)
+}
+
+func (st *sqlTx) NextFill() (int, error) {
+	return st.meta("next_fill")
+}
+
+func (st *sqlTx) SetNextFill(txn int) error {
+	return st.setMeta("next_fill", txn)
+}
+
+// meta : A number kept in the meta table. 0 if it isn't there.
+func (st *sqlTx) meta(key string) (int, error) {
+	var value int
+	err := st.tx.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return value, err
+}
+
+func (st *sqlTx) setMeta(key string, value int) error {
+	_, err := st.tx.Exec(`
+		INSERT OR REPLACE INTO meta (key, value)
+		VALUES (?, ?)`, key, value)
+	return err
+}
+
+func (st *sqlTx) Commit() error {
+	return st.tx.Commit()
+}
+
+func (st *sqlTx) Rollback() error {
+	return st.tx.Rollback()
+}
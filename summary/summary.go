@@ -0,0 +1,428 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+)
+
+// Holding : Units of a stock in the user's portfolio
+type Holding struct {
+	Stock string
+	Units accounts.Shares
+}
+
+// Position : What the user paid for a stock and what they've made on it.
+// Units and CostBasis cover every share the user hasn't sold yet,
+// including ones held by pending sells and sell triggers. Unrealized is only set when
+// PriceKnown.
+type Position struct {
+	Stock       string
+	Units       accounts.Shares
+	CostBasis   currency.Currency
+	Price       currency.Currency
+	PriceKnown  bool
+	MarketValue currency.Currency
+	Unrealized  accounts.ProfitLoss
+	Realized    accounts.ProfitLoss
+}
+
+// PendingAction : A Buy or Sell waiting to be committed
+type PendingAction struct {
+	Stock     string
+	Units     uint
+	UnitPrice currency.Currency
+	TimeLeft  time.Duration
+}
+
+// Trigger : An automated buy or sell set by the user. Trigger is only
+// set once it's Armed. Units are the shares an armed sell is holding.
+type Trigger struct {
+	ID      int
+	Stock   string
+	State   autorequests.State
+	Amount  currency.Currency
+	Trigger currency.Currency
+	Units   accounts.Shares
+}
+
+// Summary : Snapshot of everything we know about a user's account
+type Summary struct {
+	UserID       string
+	Balance      currency.Currency
+	Reserved     currency.Currency
+	Available    currency.Currency
+	Holdings     []Holding
+	Positions    []Position
+	Unrealized   accounts.ProfitLoss
+	Realized     accounts.ProfitLoss
+	PendingBuys  []PendingAction
+	PendingSells []PendingAction
+	BuyTriggers  []Trigger
+	SellTriggers []Trigger
+	History      []commands.Command
+	Ledger       []accounts.LedgerEntry
+}
+
+// Build : Collects the user's account state into a Summary. prices are
+// the latest known prices, used for unrealized profit and loss.
+func Build(
+	userID string, account *accounts.Account,
+	autoBuys, autoSells *autorequests.AutoRequestStore,
+	history []commands.Command,
+	ledger []accounts.LedgerEntry,
+	prices map[string]currency.Currency,
+) (Summary, error) {
+	s := Summary{
+		UserID:       userID,
+		Balance:      account.Balance,
+		Reserved:     account.Reserved(),
+		Available:    account.Available(),
+		Holdings:     []Holding{},
+		Positions:    []Position{},
+		PendingBuys:  pendingActions(account.BuyQueue),
+		PendingSells: pendingActions(account.SellQueue),
+		BuyTriggers:  triggers(autoBuys.GetUserAutorequests(userID)),
+		SellTriggers: triggers(autoSells.GetUserAutorequests(userID)),
+		History:      history,
+		Ledger:       ledger,
+	}
+
+	for _, stock := range sortedKeys(account.Portfolio) {
+		s.Holdings = append(s.Holdings, Holding{stock, account.Portfolio[stock]})
+	}
+
+	for _, stock := range positionStocks(account) {
+		p := Position{Stock: stock, Realized: account.Realized[stock]}
+		var err error
+		if p.Units, p.CostBasis, err = account.CostBasis(stock); err != nil {
+			return Summary{}, err
+		}
+		p.Price, p.PriceKnown = prices[stock]
+		if p.PriceKnown {
+			p.MarketValue = p.Price
+			p.MarketValue.Mul(float64(p.Units))
+			p.Unrealized = accounts.NewProfitLoss(p.MarketValue, p.CostBasis)
+		}
+
+		s.Unrealized.Add(p.Unrealized)
+		s.Realized.Add(p.Realized)
+		s.Positions = append(s.Positions, p)
+	}
+
+	return s, nil
+}
+
+// positionStocks : Stocks the user holds lots of or has sold, sorted
+func positionStocks(account *accounts.Account) []string {
+	stocks := []string{}
+	for stock := range account.Lots {
+		stocks = append(stocks, stock)
+	}
+	for stock := range account.Realized {
+		if _, found := account.Lots[stock]; !found {
+			stocks = append(stocks, stock)
+		}
+	}
+	sort.Strings(stocks)
+	return stocks
+}
+
+func pendingActions(queue accounts.ActionQueue) []PendingAction {
+	// Show the newest action first since that's the one a COMMIT acts on
+	pending := []PendingAction{}
+	for i := len(queue) - 1; i >= 0; i-- {
+		action := queue[i]
+		if action.IsExpired() {
+			continue
+		}
+		pending = append(pending, PendingAction{
+			Stock:     action.Stock,
+			Units:     action.Units,
+			UnitPrice: action.UnitPrice,
+			TimeLeft:  action.TimeLeft(),
+		})
+	}
+	return pending
+}
+
+func triggers(requests map[string][]autorequests.AutoRequest) []Trigger {
+	stocks := make([]string, 0, len(requests))
+	for stock := range requests {
+		stocks = append(stocks, stock)
+	}
+	sort.Strings(stocks)
+
+	userTriggers := []Trigger{}
+	for _, stock := range stocks {
+		for _, request := range requests[stock] {
+			userTriggers = append(userTriggers, Trigger{
+				ID:      request.ID,
+				Stock:   stock,
+				State:   request.State,
+				Amount:  request.Amount,
+				Trigger: request.Trigger,
+				Units:   request.Units,
+			})
+		}
+	}
+	return userTriggers
+}
+
+// String : e.g. "ABC #12 for $100.00 at $12.00", or "(amount set)" in
+// place of the price until it's armed
+func (t Trigger) String() string {
+	if t.State != autorequests.Armed {
+		return fmt.Sprintf("%s #%d for %s (%s)", t.Stock, t.ID, t.Amount, t.State)
+	}
+	if t.Units > 0 {
+		return fmt.Sprintf("%s #%d for %s at %s (holding %d)", t.Stock, t.ID, t.Amount, t.Trigger, t.Units)
+	}
+	return fmt.Sprintf("%s #%d for %s at %s", t.Stock, t.ID, t.Amount, t.Trigger)
+}
+
+func sortedKeys(p accounts.Portfolio) []string {
+	stocks := make([]string, 0, len(p))
+	for stock := range p {
+		stocks = append(stocks, stock)
+	}
+	sort.Strings(stocks)
+	return stocks
+}
+
+// String : Human readable report for the console
+func (s Summary) String() string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "Summary for %s\n", s.UserID)
+	fmt.Fprintf(&b, "  Balance: %s (%s reserved, %s available)\n", s.Balance, s.Reserved, s.Available)
+
+	fmt.Fprintf(&b, "  Holdings:\n")
+	for _, h := range s.Holdings {
+		fmt.Fprintf(&b, "    %-3s x %d\n", h.Stock, h.Units)
+	}
+
+	fmt.Fprintf(&b, "  Profit and loss:\n")
+	for _, p := range s.Positions {
+		worth := "no recent price"
+		if p.PriceKnown {
+			worth = fmt.Sprintf("worth %s at %s (%s unrealized)", p.MarketValue, p.Price, p.Unrealized)
+		}
+		fmt.Fprintf(&b, "    %-3s x %d cost %s, %s, %s realized\n", p.Stock, p.Units, p.CostBasis, worth, p.Realized)
+	}
+	fmt.Fprintf(&b, "    Total: %s unrealized, %s realized\n", s.Unrealized, s.Realized)
+
+	fmt.Fprintf(&b, "  Pending buys:\n")
+	for _, p := range s.PendingBuys {
+		fmt.Fprintf(&b, "    %d x %s @ %s (%s left)\n", p.Units, p.Stock, p.UnitPrice, p.TimeLeft)
+	}
+
+	fmt.Fprintf(&b, "  Pending sells:\n")
+	for _, p := range s.PendingSells {
+		fmt.Fprintf(&b, "    %d x %s @ %s (%s left)\n", p.Units, p.Stock, p.UnitPrice, p.TimeLeft)
+	}
+
+	fmt.Fprintf(&b, "  Buy triggers:\n")
+	for _, t := range s.BuyTriggers {
+		fmt.Fprintf(&b, "    %s\n", t)
+	}
+
+	fmt.Fprintf(&b, "  Sell triggers:\n")
+	for _, t := range s.SellTriggers {
+		fmt.Fprintf(&b, "    %s\n", t)
+	}
+
+	fmt.Fprintf(&b, "  History:\n")
+	for _, cmd := range s.History {
+		fmt.Fprintf(&b, "    [%d] %s %v\n", cmd.ID, cmd.Name, cmd.Args)
+	}
+
+	fmt.Fprintf(&b, "  Ledger:\n")
+	for _, e := range s.Ledger {
+		fmt.Fprintf(&b, "    [%d] %s %s: %s\n", e.TransactionNum, e.Command, e.Kind, describeEntry(e))
+	}
+
+	return b.String()
+}
+
+func describeEntry(e accounts.LedgerEntry) string {
+	switch e.Kind {
+	case accounts.ShareGrant, accounts.ShareRemoval:
+		return fmt.Sprintf("%d x %s (holding %d)", e.Units, e.Stock, e.Holding)
+	default:
+		return fmt.Sprintf("%s (balance %s)", e.Amount, e.Balance)
+	}
+}
+
+// The JSON encoding uses strings for money so the front end doesn't
+// have to deal with float rounding.
+type jsonPosition struct {
+	Stock       string          `json:"stock"`
+	Units       accounts.Shares `json:"units"`
+	CostBasis   string          `json:"costBasis"`
+	Price       string          `json:"price,omitempty"`
+	MarketValue string          `json:"marketValue,omitempty"`
+	Unrealized  string          `json:"unrealized,omitempty"`
+	Realized    string          `json:"realized"`
+}
+
+type jsonPendingAction struct {
+	Stock       string `json:"stock"`
+	Units       uint   `json:"units"`
+	UnitPrice   string `json:"unitPrice"`
+	SecondsLeft int64  `json:"secondsLeft"`
+}
+
+type jsonTrigger struct {
+	ID      int                `json:"id"`
+	Stock   string             `json:"stock"`
+	State   autorequests.State `json:"state"`
+	Amount  string             `json:"amount"`
+	Trigger string             `json:"trigger,omitempty"`
+	Units   accounts.Shares    `json:"units,omitempty"`
+}
+
+type jsonCommand struct {
+	TransactionNum int                  `json:"transactionNum"`
+	Command        commands.CommandType `json:"command"`
+	Args           []string             `json:"args"`
+}
+
+type jsonLedgerEntry struct {
+	Time           time.Time            `json:"time"`
+	TransactionNum int                  `json:"transactionNum"`
+	Command        commands.CommandType `json:"command"`
+	Kind           accounts.EntryKind   `json:"kind"`
+	Amount         string               `json:"amount,omitempty"`
+	Stock          string               `json:"stock,omitempty"`
+	Units          accounts.Shares      `json:"units,omitempty"`
+	Balance        string               `json:"balance"`
+	Holding        accounts.Shares      `json:"holding,omitempty"`
+}
+
+// MarshalJSON : Encodes the summary for the front end
+func (s Summary) MarshalJSON() ([]byte, error) {
+	out := struct {
+		UserID       string                     `json:"userID"`
+		Balance      string                     `json:"balance"`
+		Reserved     string                     `json:"reserved"`
+		Available    string                     `json:"available"`
+		Holdings     map[string]accounts.Shares `json:"holdings"`
+		Positions    []jsonPosition             `json:"positions"`
+		Unrealized   string                     `json:"unrealized"`
+		Realized     string                     `json:"realized"`
+		PendingBuys  []jsonPendingAction        `json:"pendingBuys"`
+		PendingSells []jsonPendingAction        `json:"pendingSells"`
+		BuyTriggers  []jsonTrigger              `json:"buyTriggers"`
+		SellTriggers []jsonTrigger              `json:"sellTriggers"`
+		History      []jsonCommand              `json:"history"`
+		Ledger       []jsonLedgerEntry          `json:"ledger"`
+	}{
+		UserID:       s.UserID,
+		Balance:      accounts.FormatMoney(s.Balance),
+		Reserved:     accounts.FormatMoney(s.Reserved),
+		Available:    accounts.FormatMoney(s.Available),
+		Holdings:     make(map[string]accounts.Shares),
+		Positions:    toJSONPositions(s.Positions),
+		Unrealized:   formatProfitLoss(s.Unrealized),
+		Realized:     formatProfitLoss(s.Realized),
+		PendingBuys:  toJSONPendingActions(s.PendingBuys),
+		PendingSells: toJSONPendingActions(s.PendingSells),
+		BuyTriggers:  toJSONTriggers(s.BuyTriggers),
+		SellTriggers: toJSONTriggers(s.SellTriggers),
+		History:      []jsonCommand{},
+		Ledger:       toJSONLedger(s.Ledger),
+	}
+
+	for _, h := range s.Holdings {
+		out.Holdings[h.Stock] = h.Units
+	}
+
+	for _, cmd := range s.History {
+		out.History = append(out.History, jsonCommand{cmd.ID, cmd.Name, cmd.Args})
+	}
+
+	return json.Marshal(out)
+}
+
+func toJSONPositions(positions []Position) []jsonPosition {
+	out := []jsonPosition{}
+	for _, p := range positions {
+		jp := jsonPosition{
+			Stock:     p.Stock,
+			Units:     p.Units,
+			CostBasis: accounts.FormatMoney(p.CostBasis),
+			Realized:  formatProfitLoss(p.Realized),
+		}
+		if p.PriceKnown {
+			jp.Price = accounts.FormatMoney(p.Price)
+			jp.MarketValue = accounts.FormatMoney(p.MarketValue)
+			jp.Unrealized = formatProfitLoss(p.Unrealized)
+		}
+		out = append(out, jp)
+	}
+	return out
+}
+
+func toJSONPendingActions(actions []PendingAction) []jsonPendingAction {
+	out := []jsonPendingAction{}
+	for _, p := range actions {
+		out = append(out, jsonPendingAction{
+			Stock:       p.Stock,
+			Units:       p.Units,
+			UnitPrice:   accounts.FormatMoney(p.UnitPrice),
+			SecondsLeft: int64(p.TimeLeft / time.Second),
+		})
+	}
+	return out
+}
+
+func toJSONLedger(entries []accounts.LedgerEntry) []jsonLedgerEntry {
+	out := []jsonLedgerEntry{}
+	for _, e := range entries {
+		entry := jsonLedgerEntry{
+			Time:           e.Time,
+			TransactionNum: e.TransactionNum,
+			Command:        e.Command,
+			Kind:           e.Kind,
+			Balance:        accounts.FormatMoney(e.Balance),
+		}
+		switch e.Kind {
+		case accounts.ShareGrant, accounts.ShareRemoval:
+			entry.Stock, entry.Units, entry.Holding = e.Stock, e.Units, e.Holding
+		default:
+			entry.Amount = accounts.FormatMoney(e.Amount)
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+func toJSONTriggers(triggers []Trigger) []jsonTrigger {
+	out := []jsonTrigger{}
+	for _, t := range triggers {
+		jt := jsonTrigger{ID: t.ID, Stock: t.Stock, State: t.State, Amount: accounts.FormatMoney(t.Amount), Units: t.Units}
+		if t.State == autorequests.Armed {
+			jt.Trigger = accounts.FormatMoney(t.Trigger)
+		}
+		out = append(out, jt)
+	}
+	return out
+}
+
+// formatProfitLoss : Like accounts.FormatMoney, but negative for a net loss
+func formatProfitLoss(pl accounts.ProfitLoss) string {
+	amount, negative := pl.Net()
+	if negative {
+		return "-" + accounts.FormatMoney(amount)
+	}
+	return accounts.FormatMoney(amount)
+}
@@ -0,0 +1,171 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+)
+
+// newAliceSummary : alice has $500.00 with $50.00 of it reserved for an
+// armed buy of DEF, and a second buy that only has an amount. She bought
+// 10 ABC at $2.00, sold 2 for $10.00 and has 4 held by an armed sell. She
+// also has 1 GHI bought at $9.00. ABC is at $2.50 and GHI at $6.00.
+func newAliceSummary(t *testing.T) Summary {
+	as := accounts.NewAccountStore()
+	if err := as.CreateAccount("alice"); err != nil {
+		t.Fatal(err)
+	}
+	alice := as.GetAccount("alice")
+
+	alice.AddFunds(accounts.Tx{ID: 1, Command: commands.Add}, testutil.Money(t, "500.00"))
+	buy := accounts.Tx{ID: 2, Command: commands.CommitBuy}
+	if err := alice.BuyStock(buy, "ABC", 10, testutil.Money(t, "2.00")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.BuyStock(buy, "GHI", 1, testutil.Money(t, "9.00")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.RemoveStockFromPortfolio(accounts.Tx{ID: 4, Command: commands.Sell}, "ABC", 2); err != nil {
+		t.Fatal(err)
+	}
+	alice.SellLots("ABC", 2, testutil.Money(t, "10.00"))
+
+	reservationID, err := alice.Reserve(testutil.Money(t, "50.00"), "SET_BUY_AMOUNT DEF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	autoBuys := autorequests.NewAutoRequestStore()
+	if _, err := autoBuys.AddAutorequest("DEF", "alice", 3, testutil.Money(t, "50.00"), reservationID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := autoBuys.SetTrigger("DEF", "alice", 3, testutil.Money(t, "5.00")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := autoBuys.AddAutorequest("DEF", "alice", 7, testutil.Money(t, "20.00"), accounts.NoReservation); err != nil {
+		t.Fatal(err)
+	}
+
+	autoSells := autorequests.NewAutoRequestStore()
+	if _, err := autoSells.AddAutorequest("ABC", "alice", 5, testutil.Money(t, "12.00"), accounts.NoReservation); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := autoSells.SetTrigger("ABC", "alice", 5, testutil.Money(t, "3.00")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.RemoveStockFromPortfolio(accounts.Tx{ID: 6, Command: commands.SetSellTrigger}, "ABC", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := autoSells.HoldShares("ABC", "alice", 5, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	history := []commands.Command{
+		{ID: 1, Name: commands.Add, UserID: "alice", Args: []string{"500.00"}},
+		{ID: 3, Name: commands.SetBuyAmount, UserID: "alice", Args: []string{"DEF", "50.00"}},
+	}
+
+	// The account's own ledger entries are stamped with the time they
+	// were made, so the summary is given ones with a fixed time
+	at := time.Date(2017, time.January, 2, 3, 4, 5, 0, time.UTC)
+	ledger := []accounts.LedgerEntry{
+		{Time: at, UserID: "alice", TransactionNum: 1, Command: commands.Add, Kind: accounts.Credit,
+			Amount: testutil.Money(t, "500.00"), Balance: testutil.Money(t, "500.00")},
+		{Time: at.Add(time.Second), UserID: "alice", TransactionNum: 2, Command: commands.CommitBuy, Kind: accounts.ShareGrant,
+			Stock: "ABC", Units: 10, Balance: testutil.Money(t, "500.00"), Holding: 10},
+	}
+
+	prices := map[string]currency.Currency{
+		"ABC": testutil.Money(t, "2.50"),
+		"GHI": testutil.Money(t, "6.00"),
+	}
+
+	s, err := Build("alice", alice, autoBuys, autoSells, history, ledger, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestString(t *testing.T) {
+	want := `Summary for alice
+  Balance: $500.00 ($50.00 reserved, $450.00 available)
+  Holdings:
+    ABC x 4
+    GHI x 1
+  Profit and loss:
+    ABC x 8 cost $16.00, worth $20.00 at $2.50 (+$4.00 unrealized), +$6.00 realized
+    GHI x 1 cost $9.00, worth $6.00 at $6.00 (-$3.00 unrealized), +$0.00 realized
+    Total: +$1.00 unrealized, +$6.00 realized
+  Pending buys:
+  Pending sells:
+  Buy triggers:
+    DEF #3 for $50.00 at $5.00
+    DEF #7 for $20.00 (amount set)
+  Sell triggers:
+    ABC #5 for $12.00 at $3.00 (holding 4)
+  History:
+    [1] ADD [500.00]
+    [3] SET_BUY_AMOUNT [DEF 50.00]
+  Ledger:
+    [1] ADD credit: $500.00 (balance $500.00)
+    [2] COMMIT_BUY share grant: 10 x ABC (holding 10)
+`
+
+	if got := newAliceSummary(t).String(); got != want {
+		t.Errorf("summary reads\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	// Money is a plain decimal string, with a sign only for a net loss
+	want := `{
+		"userID": "alice",
+		"balance": "500.00",
+		"reserved": "50.00",
+		"available": "450.00",
+		"holdings": {"ABC": 4, "GHI": 1},
+		"positions": [
+			{"stock": "ABC", "units": 8, "costBasis": "16.00", "price": "2.50", "marketValue": "20.00", "unrealized": "4.00", "realized": "6.00"},
+			{"stock": "GHI", "units": 1, "costBasis": "9.00", "price": "6.00", "marketValue": "6.00", "unrealized": "-3.00", "realized": "0.00"}
+		],
+		"unrealized": "1.00",
+		"realized": "6.00",
+		"pendingBuys": [],
+		"pendingSells": [],
+		"buyTriggers": [
+			{"id": 3, "stock": "DEF", "state": "armed", "amount": "50.00", "trigger": "5.00"},
+			{"id": 7, "stock": "DEF", "state": "amount set", "amount": "20.00"}
+		],
+		"sellTriggers": [
+			{"id": 5, "stock": "ABC", "state": "armed", "amount": "12.00", "trigger": "3.00", "units": 4}
+		],
+		"history": [
+			{"transactionNum": 1, "command": "ADD", "args": ["500.00"]},
+			{"transactionNum": 3, "command": "SET_BUY_AMOUNT", "args": ["DEF", "50.00"]}
+		],
+		"ledger": [
+			{"time": "2017-01-02T03:04:05Z", "transactionNum": 1, "command": "ADD", "kind": "credit", "amount": "500.00", "balance": "500.00"},
+			{"time": "2017-01-02T03:04:06Z", "transactionNum": 2, "command": "COMMIT_BUY", "kind": "share grant", "stock": "ABC", "units": 10, "balance": "500.00", "holding": 10}
+		]
+	}`
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := json.Marshal(newAliceSummary(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != compact.String() {
+		t.Errorf("summary encodes as\n%s\nwant\n%s", got, compact.String())
+	}
+}
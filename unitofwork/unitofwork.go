@@ -0,0 +1,105 @@
+package unitofwork
+
+import (
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+)
+
+// savedUser : A user's account and triggers from before the unit of work
+// first touched them. account is nil if they didn't have one.
+type savedUser struct {
+	account   *accounts.Snapshot
+	autoBuys  map[string][]autorequests.AutoRequest
+	autoSells map[string][]autorequests.AutoRequest
+}
+
+// UnitOfWork : Every change a command makes to accounts and triggers.
+// The first time a user is touched their account and triggers are copied.
+// If the command fails, Rollback puts the copies back and drops the ledger
+// entries it made, so nothing changes. Side effects that can't be undone,
+// like writing to the audit log, wait in OnCommit until the command
+// succeeds.
+//
+// Changes are made in place, so only one UnitOfWork should be open at a time.
+type UnitOfWork struct {
+	accounts  *accounts.AccountStore
+	autoBuys  *autorequests.AutoRequestStore
+	autoSells *autorequests.AutoRequestStore
+
+	ledgerLen int
+	saved     map[string]savedUser
+	onCommit  []func()
+	done      bool
+}
+
+// Begin : Starts a unit of work over the stores
+func Begin(
+	as *accounts.AccountStore,
+	autoBuys, autoSells *autorequests.AutoRequestStore,
+) *UnitOfWork {
+	return &UnitOfWork{
+		accounts:  as,
+		autoBuys:  autoBuys,
+		autoSells: autoSells,
+		ledgerLen: as.Ledger.Len(),
+		saved:     make(map[string]savedUser),
+	}
+}
+
+// Account : The user's account, or nil if they don't have one. Get the
+// account through here before changing it or the user's triggers.
+func (uw *UnitOfWork) Account(userID string) *accounts.Account {
+	account := uw.accounts.GetAccount(userID)
+
+	if _, found := uw.saved[userID]; !found {
+		saved := savedUser{
+			autoBuys:  uw.autoBuys.GetUserAutorequests(userID),
+			autoSells: uw.autoSells.GetUserAutorequests(userID),
+		}
+		if account != nil {
+			s := account.Snapshot()
+			saved.account = &s
+		}
+		uw.saved[userID] = saved
+	}
+
+	return account
+}
+
+// OnCommit : Runs fn if the work is committed. Functions run in the
+// order they were added.
+func (uw *UnitOfWork) OnCommit(fn func()) {
+	uw.onCommit = append(uw.onCommit, fn)
+}
+
+// Commit : Keeps every change and runs the OnCommit functions
+func (uw *UnitOfWork) Commit() {
+	if uw.done {
+		return
+	}
+	uw.done = true
+
+	for _, fn := range uw.onCommit {
+		fn()
+	}
+}
+
+// Rollback : Puts every account and trigger touched back the way it was
+func (uw *UnitOfWork) Rollback() {
+	if uw.done {
+		return
+	}
+	uw.done = true
+
+	for userID, saved := range uw.saved {
+		if saved.account == nil {
+			uw.accounts.RemoveAccount(userID)
+		} else {
+			uw.accounts.RestoreAccount(userID, *saved.account)
+		}
+		uw.autoBuys.SetUserAutorequests(userID, saved.autoBuys)
+		uw.autoSells.SetUserAutorequests(userID, saved.autoSells)
+	}
+
+	uw.accounts.Ledger.Rollback(uw.ledgerLen)
+}
@@ -0,0 +1,305 @@
+package unitofwork_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/distributeddesigns/currency"
+
+	"github.com/distributeddesigns/milestone1/accounts"
+	"github.com/distributeddesigns/milestone1/autorequests"
+	"github.com/distributeddesigns/milestone1/commands"
+	"github.com/distributeddesigns/milestone1/internal/testutil"
+	"github.com/distributeddesigns/milestone1/unitofwork"
+)
+
+var (
+	setupTx   = accounts.Tx{ID: 1, Command: commands.Add}
+	handlerTx = accounts.Tx{ID: 2, Command: commands.SetSellTrigger}
+
+	errInjected = errors.New("Injected failure")
+)
+
+// stores : Everything a unit of work covers
+type stores struct {
+	accounts  *accounts.AccountStore
+	autoBuys  *autorequests.AutoRequestStore
+	autoSells *autorequests.AutoRequestStore
+}
+
+// newStores : alice has cash, some of it reserved for an automated buy,
+// shares of ABC and an automated sell waiting for a trigger. The setup is
+// in the ledger so rolling back has entries to keep.
+func newStores(t *testing.T) stores {
+	s := stores{
+		accounts:  accounts.NewAccountStore(),
+		autoBuys:  autorequests.NewAutoRequestStore(),
+		autoSells: autorequests.NewAutoRequestStore(),
+	}
+
+	if err := s.accounts.CreateAccount("alice"); err != nil {
+		t.Fatal(err)
+	}
+	alice := s.accounts.GetAccount("alice")
+	alice.AddFunds(setupTx, testutil.Money(t, "100.00"))
+	if err := alice.BuyStock(setupTx, "ABC", 10, testutil.Money(t, "1.50")); err != nil {
+		t.Fatal(err)
+	}
+
+	reservationID, err := alice.Reserve(testutil.Money(t, "30.00"), "SET_BUY_AMOUNT DEF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.autoBuys.AddAutorequest("DEF", "alice", 1, testutil.Money(t, "30.00"), reservationID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.autoBuys.SetTrigger("DEF", "alice", 1, testutil.Money(t, "3.00")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.autoSells.AddAutorequest("ABC", "alice", 1, testutil.Money(t, "8.00"), accounts.NoReservation); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// state : What a failed command must leave untouched
+type state struct {
+	accounts  map[string]accounts.Snapshot
+	reserved  map[string]currency.Currency
+	autoBuys  map[string]map[string][]autorequests.AutoRequest
+	autoSells map[string]map[string][]autorequests.AutoRequest
+	ledger    []accounts.LedgerEntry
+}
+
+func (s stores) state(users ...string) state {
+	st := state{
+		accounts:  make(map[string]accounts.Snapshot),
+		reserved:  make(map[string]currency.Currency),
+		autoBuys:  make(map[string]map[string][]autorequests.AutoRequest),
+		autoSells: make(map[string]map[string][]autorequests.AutoRequest),
+		ledger:    s.accounts.Ledger.Since(0),
+	}
+
+	for _, userID := range users {
+		if account := s.accounts.GetAccount(userID); account != nil {
+			st.accounts[userID] = account.Snapshot()
+			st.reserved[userID] = account.Reserved()
+		}
+		st.autoBuys[userID] = s.autoBuys.GetUserAutorequests(userID)
+		st.autoSells[userID] = s.autoSells.GetUserAutorequests(userID)
+	}
+
+	return st
+}
+
+func checkState(t *testing.T, got, want state) {
+	if !reflect.DeepEqual(got.accounts, want.accounts) {
+		t.Errorf("accounts:\n got %+v\nwant %+v", got.accounts, want.accounts)
+	}
+	if !reflect.DeepEqual(got.reserved, want.reserved) {
+		t.Errorf("reserved funds: got %v, want %v", got.reserved, want.reserved)
+	}
+	if !reflect.DeepEqual(got.autoBuys, want.autoBuys) {
+		t.Errorf("automated buys:\n got %+v\nwant %+v", got.autoBuys, want.autoBuys)
+	}
+	if !reflect.DeepEqual(got.autoSells, want.autoSells) {
+		t.Errorf("automated sells:\n got %+v\nwant %+v", got.autoSells, want.autoSells)
+	}
+	if len(got.ledger) != len(want.ledger) {
+		t.Errorf("ledger has %d entries, want %d", len(got.ledger), len(want.ledger))
+	} else if !reflect.DeepEqual(got.ledger, want.ledger) {
+		t.Errorf("ledger:\n got %+v\nwant %+v", got.ledger, want.ledger)
+	}
+}
+
+// step : One change a handler makes through the unit of work
+type step struct {
+	name string
+	run  func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error
+}
+
+// steps : A handler that touches every kind of state, in the order a
+// command would. Failing before any of them must undo the ones before.
+var steps = []step{
+	{"add funds", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		work.Account("alice").AddFunds(handlerTx, testutil.Money(t, "25.00"))
+		return nil
+	}},
+	{"remove funds", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		return work.Account("alice").RemoveFunds(handlerTx, testutil.Money(t, "10.00"))
+	}},
+	{"reserve funds", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		_, err := work.Account("alice").Reserve(testutil.Money(t, "20.00"), "BUY GHI")
+		return err
+	}},
+	{"release reservation", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		request, err := s.autoBuys.GetAutorequest("DEF", "alice", 1)
+		if err != nil {
+			return err
+		}
+		_, err = work.Account("alice").ReleaseReservation(request.ReservationID)
+		return err
+	}},
+	{"cancel automated buy", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		work.Account("alice")
+		_, err := s.autoBuys.CancelAutorequest("DEF", "alice", 1)
+		return err
+	}},
+	{"buy stock", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		return work.Account("alice").BuyStock(handlerTx, "GHI", 4, testutil.Money(t, "2.00"))
+	}},
+	{"queue a buy", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		account := work.Account("alice")
+		reservationID, err := account.Reserve(testutil.Money(t, "5.00"), "BUY JKL")
+		if err != nil {
+			return err
+		}
+		account.AddToBuyQueue("JKL", 1, testutil.Money(t, "5.00"), reservationID)
+		return nil
+	}},
+	{"arm automated sell", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		work.Account("alice")
+		_, err := s.autoSells.SetTrigger("ABC", "alice", 1, testutil.Money(t, "2.00"))
+		return err
+	}},
+	{"hold shares", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		account := work.Account("alice")
+		if err := account.RemoveStockFromPortfolio(handlerTx, "ABC", 4); err != nil {
+			return err
+		}
+		return s.autoSells.HoldShares("ABC", "alice", 1, 4)
+	}},
+	{"sell lots", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		account := work.Account("alice")
+		if err := account.RemoveStockFromPortfolio(handlerTx, "ABC", 2); err != nil {
+			return err
+		}
+		account.SellLots("ABC", 2, testutil.Money(t, "5.00"))
+		return nil
+	}},
+	{"new automated buy", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		work.Account("alice")
+		_, err := s.autoBuys.AddAutorequest("ABC", "alice", 2, testutil.Money(t, "1.00"), accounts.NoReservation)
+		return err
+	}},
+	{"create account", func(t *testing.T, s stores, work *unitofwork.UnitOfWork) error {
+		if work.Account("bob") != nil {
+			return errors.New("bob already has an account")
+		}
+		if err := s.accounts.CreateAccount("bob"); err != nil {
+			return err
+		}
+		work.Account("bob").AddFunds(handlerTx, testutil.Money(t, "40.00"))
+		_, err := s.autoSells.AddAutorequest("ABC", "bob", 2, testutil.Money(t, "4.00"), accounts.NoReservation)
+		return err
+	}},
+}
+
+// runHandler : Runs the steps through work, failing with errInjected
+// before step failAt. Every step is run if failAt is past the end.
+func runHandler(t *testing.T, s stores, work *unitofwork.UnitOfWork, failAt int) error {
+	for i, st := range steps {
+		if i == failAt {
+			return errInjected
+		}
+		if err := st.run(t, s, work); err != nil {
+			t.Fatalf("%s: %s", st.name, err.Error())
+		}
+	}
+	if failAt == len(steps) {
+		return errInjected
+	}
+	return nil
+}
+
+func TestFailedHandlerChangesNothing(t *testing.T) {
+	for failAt := 0; failAt <= len(steps); failAt++ {
+		name := "after every step"
+		if failAt < len(steps) {
+			name = "before " + steps[failAt].name
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newStores(t)
+			before := s.state("alice", "bob")
+
+			committed := false
+			work := unitofwork.Begin(s.accounts, s.autoBuys, s.autoSells)
+			work.OnCommit(func() { committed = true })
+
+			if err := runHandler(t, s, work, failAt); err != errInjected {
+				t.Fatalf("handler returned %v, want the injected failure", err)
+			}
+			work.Rollback()
+
+			checkState(t, s.state("alice", "bob"), before)
+			if s.accounts.HasAccount("bob") {
+				t.Error("account created by the failed handler is still there")
+			}
+			if committed {
+				t.Error("OnCommit ran for a failed handler")
+			}
+
+			// Finished work can't be committed afterwards
+			work.Commit()
+			if committed {
+				t.Error("OnCommit ran after Rollback")
+			}
+		})
+	}
+}
+
+func TestFailedHandlerLeavesEarlierWork(t *testing.T) {
+	s := newStores(t)
+
+	work := unitofwork.Begin(s.accounts, s.autoBuys, s.autoSells)
+	if err := runHandler(t, s, work, len(steps)+1); err != nil {
+		t.Fatal(err)
+	}
+	work.Commit()
+	committed := s.state("alice", "bob")
+
+	// Rolling back the second handler keeps what the first committed
+	work = unitofwork.Begin(s.accounts, s.autoBuys, s.autoSells)
+	work.Account("alice").AddFunds(handlerTx, testutil.Money(t, "1.00"))
+	if err := work.Account("alice").RemoveStockFromPortfolio(handlerTx, "GHI", 4); err != nil {
+		t.Fatal(err)
+	}
+	work.Rollback()
+
+	checkState(t, s.state("alice", "bob"), committed)
+}
+
+func TestCommitKeepsChangesInOrder(t *testing.T) {
+	s := newStores(t)
+	ledgerLen := s.accounts.Ledger.Len()
+
+	var ran []string
+	work := unitofwork.Begin(s.accounts, s.autoBuys, s.autoSells)
+	for i := 0; i < 3; i++ {
+		i := i
+		work.OnCommit(func() { ran = append(ran, fmt.Sprint(i)) })
+	}
+	if err := runHandler(t, s, work, len(steps)+1); err != nil {
+		t.Fatal(err)
+	}
+	work.Commit()
+
+	if !reflect.DeepEqual(ran, []string{"0", "1", "2"}) {
+		t.Errorf("OnCommit ran %v, want [0 1 2]", ran)
+	}
+	if !s.accounts.HasAccount("bob") {
+		t.Error("committed account was not kept")
+	}
+	if s.accounts.Ledger.Len() == ledgerLen {
+		t.Error("committed ledger entries were not kept")
+	}
+
+	// Finished work can't be rolled back afterwards
+	kept := s.state("alice", "bob")
+	work.Rollback()
+	checkState(t, s.state("alice", "bob"), kept)
+}